@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Alert reports the holes that appeared or were fixed between two
+// completed runs of a scheduled check. Holes are the events of the runs
+// reporting a problem, in the same shape as the websocket messages.
+type Alert struct {
+	Schedule      string     `json:"schedule"`
+	Check         string     `json:"check"`
+	JobID         string     `json:"jobId"`
+	PreviousJobID string     `json:"previousJobId"`
+	HoleCount     int        `json:"holeCount"`
+	NewHoles      []JobEvent `json:"newHoles"`
+	FixedHoles    []JobEvent `json:"fixedHoles"`
+}
+
+type alertSink interface {
+	send(alert *Alert) error
+	String() string
+}
+
+// logAlertSink logs a line per alert.
+type logAlertSink struct{}
+
+func (logAlertSink) send(alert *Alert) error {
+	zlog.Warn("scheduled check holes changed",
+		zap.String("schedule", alert.Schedule),
+		zap.String("check", alert.Check),
+		zap.String("job_id", alert.JobID),
+		zap.String("previous_job_id", alert.PreviousJobID),
+		zap.Int("hole_count", alert.HoleCount),
+		zap.Int("new_hole_count", len(alert.NewHoles)),
+		zap.Int("fixed_hole_count", len(alert.FixedHoles)),
+	)
+	return nil
+}
+
+func (logAlertSink) String() string {
+	return "log"
+}
+
+// webhookAlertSink posts every alert as JSON to a URL, any 2xx response
+// being a success.
+type webhookAlertSink struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhookAlertSink(url string) *webhookAlertSink {
+	return &webhookAlertSink{
+		url:    url,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *webhookAlertSink) send(alert *Alert) error {
+	data, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("webhook responded %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	return nil
+}
+
+func (s *webhookAlertSink) String() string {
+	return "webhook " + s.url
+}
+
+// runAlertReceiver implements `diagnose alert-receiver`, a stand-in
+// webhook receiver printing every alert it receives to stdout, one JSON
+// object per line.
+func runAlertReceiver(args []string) int {
+	flags := flag.NewFlagSet("alert-receiver", flag.ContinueOnError)
+	addr := flags.String("listen-addr", ":9090", "TCP listener address of the receiver")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		var alert Alert
+		if err := json.NewDecoder(req.Body).Decode(&alert); err != nil {
+			http.Error(w, fmt.Sprintf("invalid alert: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		data, _ := json.Marshal(alert)
+		fmt.Fprintln(os.Stdout, string(data))
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	fmt.Fprintf(os.Stderr, "receiving alerts on %s\n", *addr)
+	if err := http.ListenAndServe(*addr, nil); err != nil {
+		fmt.Fprintf(os.Stderr, "alert receiver failed: %s\n", err)
+		return 2
+	}
+
+	return 0
+}
@@ -1,89 +1,83 @@
 package main
 
 import (
-	"context"
+	"fmt"
 	"net/http"
-	"regexp"
 	"strconv"
-	"time"
 
-	"github.com/eoscanada/dstore"
+	"github.com/eoscanada/diagnose/checker"
 	"go.uber.org/zap"
 )
 
 func (d *Diagnose) BlockHoles(w http.ResponseWriter, req *http.Request) {
-	blocksURL := getQueryParam(req, "blocks_url")
-	if blocksURL == "" {
-		blocksURL = d.BlocksStoreURL
-	}
+	d.serveCheck(w, req, d.newBlockHoles)
+}
 
-	const fileBlockSize = 100
-	zlog.Info("diagnose - block holes",
-		zap.String("block_store_url", blocksURL),
-		zap.Uint32("block_logs_size", fileBlockSize),
-	)
+func (d *Diagnose) newBlockHoles(param paramFunc) (checker.Checker, error) {
+	blocksURL := d.blocksURL(param)
 
-	conn, err := d.upgrader.Upgrade(w, req, nil)
+	startBlock, stopBlock, err := blockBounds(param)
 	if err != nil {
-		return
+		return nil, err
 	}
-	defer conn.Close()
-
-	ctx, cancel := context.WithCancel(req.Context())
 
-	number := regexp.MustCompile(`(\d{10})`)
-
-	var expected uint32
-	var count int
-	var baseNum32 uint32
-	currentStartBlk := uint32(0)
-	startTime := time.Now()
-
-	go readWebsocket(conn, cancel)
+	layout, err := blockFilesLayout(param)
+	if err != nil {
+		return nil, err
+	}
 
-	zlog.Info("creating blocks store")
-	blocksStore, err := dstore.NewDBinStore(blocksURL)
+	deep, err := boolParam(param, "deep")
 	if err != nil {
-		maybeSendWebsocket(conn, WebsocketTypeMessage, Message{Msg: err.Error()})
-		return
+		return nil, err
 	}
 
-	maybeSendWebsocket(conn, WebsocketTypeProgress, Progress{Elapsed: time.Now().Sub(startTime)})
-	blocksStore.Walk("", "", func(filename string) error {
-		select {
-		case <-ctx.Done():
-			zlog.Debug("context canceled")
-			return dstore.StopIteration
-		default:
-		}
+	zlog.Info("diagnose - block holes",
+		zap.String("block_store_url", blocksURL),
+		zap.Reflect("layout", layout),
+		zap.Bool("deep", deep),
+	)
+	return &checker.BlockHoles{
+		BlocksStoreURL: blocksURL,
+		Layout:         layout,
+		StartBlock:     startBlock,
+		StopBlock:      stopBlock,
+		Deep:           deep,
+	}, nil
+}
 
-		if count%5000 == 0 {
-			maybeSendWebsocket(conn, WebsocketTypeProgress, Progress{Elapsed: time.Now().Sub(startTime)})
-		}
+// blocksURL reads the optional `blocks_url` parameter, defaulting to the
+// configured blocks store.
+func (d *Diagnose) blocksURL(param paramFunc) string {
+	if blocksURL := param("blocks_url"); blocksURL != "" {
+		return blocksURL
+	}
+	return d.BlocksStoreURL
+}
 
-		match := number.FindStringSubmatch(filename)
-		if match == nil {
-			return nil
-		}
+// blockFilesLayout reads the `layout` preset, `merged` by default, and
+// lets `bundle_size` and `filename_pattern` override its values.
+func blockFilesLayout(param paramFunc) (checker.BlockFilesLayout, error) {
+	name := param("layout")
+	if name == "" {
+		name = "merged"
+	}
 
-		count++
-		baseNum, _ := strconv.ParseUint(match[1], 10, 32)
-		baseNum32 = uint32(baseNum)
+	layout, found := checker.BlockFilesLayouts[name]
+	if !found {
+		return layout, fmt.Errorf("unknown layout %q, expected 'merged' or 'one-block'", name)
+	}
 
-		if baseNum32 != expected {
-			maybeSendWebsocket(conn, WebsocketTypeBlockRange, NewValidBlockRange(currentStartBlk, (expected-fileBlockSize), "valid range"))
-			maybeSendWebsocket(conn, WebsocketTypeBlockRange, NewMissingBlockRange(expected, (baseNum32-fileBlockSize), "hole found"))
-			currentStartBlk = baseNum32
+	if value := param("bundle_size"); value != "" {
+		bundleSize, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || bundleSize == 0 {
+			return layout, fmt.Errorf("invalid bundle_size %q, expected a positive number", value)
 		}
-		expected = baseNum32 + fileBlockSize
+		layout.BundleSize = uint32(bundleSize)
+	}
 
-		if count%10000 == 0 {
-			maybeSendWebsocket(conn, WebsocketTypeBlockRange, NewValidBlockRange(currentStartBlk, baseNum32, "valid range"))
-			currentStartBlk = baseNum32 + fileBlockSize
-		}
+	if pattern := param("filename_pattern"); pattern != "" {
+		layout.FilenamePattern = pattern
+	}
 
-		return nil
-	})
-	maybeSendWebsocket(conn, WebsocketTypeBlockRange, NewValidBlockRange(currentStartBlk, baseNum32, "valid range"))
-	zlog.Info("diagnose - block holes - completed")
+	return layout, nil
 }
@@ -0,0 +1,175 @@
+package checker
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/eoscanada/bstream"
+	"github.com/eoscanada/dstore"
+)
+
+// maxFileProblems caps the number of problems reported for a single file,
+// a badly broken file would otherwise produce one problem per block.
+const maxFileProblems = 5
+
+// blockLink holds the IDs of the highest block of the previous file, used
+// to validate the link of the first block of the next file.
+type blockLink struct {
+	num uint32
+	ids []string
+}
+
+// validateBlocksFile decodes every block of a merged blocks file holding
+// blocks `baseNum` through `baseNum + bundleSize - 1` and returns the
+// problems found, an empty slice meaning the file is valid. `previous` is
+// the last block of the previous file, nil when it is unknown. The last
+// block of this file is returned to validate the next one.
+//
+// Forked blocks are accepted: a block number may appear more than once as
+// long as each block links to a known block at the height below it. Only
+// the exact same block appearing twice is a duplicate.
+func validateBlocksFile(store dstore.Store, filename string, baseNum, bundleSize uint32, previous *blockLink) (problems []string, last *blockLink) {
+	report := func(format string, args ...interface{}) {
+		if len(problems) < maxFileProblems {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	reader, err := store.OpenObject(filename)
+	if err != nil {
+		report("cannot open file: %s", err)
+		return
+	}
+	defer reader.Close()
+
+	blockReader, err := bstream.NewDBinBlockReader(reader, nil)
+	if err != nil {
+		report("cannot read file header: %s", err)
+		return
+	}
+
+	idsByNum := map[uint32][]string{}
+	seenIDs := map[string]bool{}
+	if previous != nil {
+		idsByNum[previous.num] = previous.ids
+	}
+
+	lastNum := uint32(0)
+	count := 0
+	for {
+		block, err := blockReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if count == 0 {
+				report("decode error on first block: %s", err)
+			} else {
+				report("decode error after block %d: %s", lastNum, err)
+			}
+			break
+		}
+
+		count++
+		num := uint32(block.Num())
+		id := block.ID()
+		lastNum = num
+
+		if num < baseNum || num >= baseNum+bundleSize {
+			report("unexpected block %d outside of file range", num)
+			continue
+		}
+
+		if seenIDs[id] {
+			report("duplicate block %d (%s)", num, id)
+			continue
+		}
+		seenIDs[id] = true
+
+		if parents, found := idsByNum[num-1]; found && !containsString(parents, block.PreviousID()) {
+			report("block %d previous ID %s does not link to block %d (%s)", num, block.PreviousID(), num-1, strings.Join(parents, ", "))
+		}
+
+		idsByNum[num] = append(idsByNum[num], id)
+		if last == nil || num > last.num {
+			last = &blockLink{num: num}
+		}
+	}
+
+	if count == 0 {
+		report("empty file")
+		return
+	}
+
+	if last != nil {
+		last.ids = idsByNum[last.num]
+	}
+
+	// Chains do not start at block 0, the first file is allowed to start
+	// at its first actual block.
+	firstExpected := baseNum
+	if baseNum == 0 {
+		firstExpected = baseNum + bundleSize
+		for num := range idsByNum {
+			if num < firstExpected && (previous == nil || num != previous.num) {
+				firstExpected = num
+			}
+		}
+	}
+
+	missingStart := int64(-1)
+	for num := firstExpected; num < baseNum+bundleSize; num++ {
+		_, found := idsByNum[num]
+		if !found && missingStart < 0 {
+			missingStart = int64(num)
+		}
+		if found && missingStart >= 0 {
+			report("missing blocks %d-%d", missingStart, num-1)
+			missingStart = -1
+		}
+	}
+	if missingStart >= 0 {
+		report("missing blocks %d-%d", missingStart, baseNum+bundleSize-1)
+	}
+
+	return
+}
+
+func containsString(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// readBlocksFileIDs decodes a merged blocks file and returns the IDs of
+// the blocks it holds, by block number.
+func readBlocksFileIDs(store dstore.Store, filename string) (map[uint32][]string, error) {
+	reader, err := store.OpenObject(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open file: %s", err)
+	}
+	defer reader.Close()
+
+	blockReader, err := bstream.NewDBinBlockReader(reader, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read file header: %s", err)
+	}
+
+	out := map[uint32][]string{}
+	for {
+		block, err := blockReader.Read()
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return out, fmt.Errorf("decode error: %s", err)
+		}
+
+		num := uint32(block.Num())
+		out[num] = append(out[num], block.ID())
+	}
+}
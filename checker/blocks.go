@@ -0,0 +1,215 @@
+package checker
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eoscanada/dstore"
+	"go.uber.org/zap"
+)
+
+// BlockFilesLayout describes how blocks are bundled in the files of a
+// blocks store: every file holds `BundleSize` blocks and the first
+// capture group of `FilenamePattern` is the file's base block number.
+type BlockFilesLayout struct {
+	BundleSize      uint32
+	FilenamePattern string
+}
+
+var (
+	MergedBlocksLayout = BlockFilesLayout{BundleSize: 100, FilenamePattern: `(\d{10})`}
+	OneBlockLayout     = BlockFilesLayout{BundleSize: 1, FilenamePattern: `(\d{10})-`}
+)
+
+// BlockFilesLayouts are the layout presets, by name.
+var BlockFilesLayouts = map[string]BlockFilesLayout{
+	"merged":    MergedBlocksLayout,
+	"one-block": OneBlockLayout,
+}
+
+func isPresetFilenamePattern(pattern string) bool {
+	for _, layout := range BlockFilesLayouts {
+		if layout.FilenamePattern == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// BlockHoles walks a blocks store and reports the ranges of missing block
+// files. The store layout defaults to `MergedBlocksLayout`. With `Deep`,
+// every file is also downloaded and decoded, and a file that is
+// unreadable, misses blocks, holds duplicates or breaks the chain of
+// previous IDs is reported as its own hole along with the reason.
+//
+// Without a `StartBlock`, the range starts at the first file of the store
+// instead of block 0. Files straddling `StartBlock` or `StopBlock` are
+// only reported for the blocks within the range. A checkpoint is saved every few thousand files, or
+// every few dozen with `Deep`.
+type BlockHoles struct {
+	BlocksStoreURL string
+	Layout         BlockFilesLayout
+	StartBlock     uint32
+	StopBlock      uint32
+	Deep           bool
+
+	Checkpointing
+}
+
+func (c *BlockHoles) Check(ctx context.Context, emitter Emitter) error {
+	layout := c.Layout
+	if layout.BundleSize == 0 {
+		layout.BundleSize = MergedBlocksLayout.BundleSize
+	}
+	if layout.FilenamePattern == "" {
+		layout.FilenamePattern = MergedBlocksLayout.FilenamePattern
+	}
+
+	bundleSize := layout.BundleSize
+	zlog.Info("block holes",
+		zap.String("block_store_url", c.BlocksStoreURL),
+		zap.Uint32("bundle_size", bundleSize),
+		zap.String("filename_pattern", layout.FilenamePattern),
+		zap.Uint32("start_block", c.StartBlock),
+		zap.Uint32("stop_block", c.StopBlock),
+		zap.Bool("deep", c.Deep),
+	)
+
+	number, err := regexp.Compile(layout.FilenamePattern)
+	if err != nil {
+		return fmt.Errorf("invalid filename pattern %q: %s", layout.FilenamePattern, err)
+	}
+	if number.NumSubexp() < 1 {
+		return fmt.Errorf("filename pattern %q must capture the base block number", layout.FilenamePattern)
+	}
+
+	startBase := c.StartBlock / bundleSize * bundleSize
+	stopBase := c.StopBlock / bundleSize * bundleSize
+	bounded := c.StopBlock != 0
+
+	tracker := newRangeTracker(emitter, "hole found")
+	tracker.clamp(c.StartBlock, c.StopBlock)
+	if c.StartBlock != 0 {
+		tracker.startAt(startBase)
+	}
+
+	var count int
+	startTime := time.Now()
+
+	progressInterval := 5000
+	if c.Deep {
+		progressInterval = 50
+	}
+	var previous *blockLink
+	var previousBase uint32
+
+	walkBase := startBase
+	if checkpoint := c.ResumeFrom; checkpoint != nil {
+		tracker.restore(*checkpoint)
+		walkBase = checkpoint.NextBlock
+		count = int(checkpoint.Counters["files"])
+		if len(checkpoint.LastBlockIDs) > 0 {
+			previous = &blockLink{num: checkpoint.LastBlockNum, ids: checkpoint.LastBlockIDs}
+			previousBase = checkpoint.NextBlock - bundleSize
+		}
+	}
+
+	zlog.Info("creating blocks store")
+	blocksStore, err := dstore.NewDBinStore(c.BlocksStoreURL)
+	if err != nil {
+		return fmt.Errorf("unable to create blocks store: %s", err)
+	}
+
+	emitter.Emit(TypeProgress, Progress{Elapsed: time.Now().Sub(startTime)})
+	// Filenames only start with the 10 digits base block number in the
+	// preset layouts, the whole store is walked for a custom pattern.
+	prefix := ""
+	if isPresetFilenamePattern(layout.FilenamePattern) {
+		prefix = filenamePrefix(walkBase, stopBase, bounded)
+	}
+
+	err = blocksStore.Walk(prefix, "", func(filename string) error {
+		select {
+		case <-ctx.Done():
+			zlog.Debug("context canceled")
+			return dstore.StopIteration
+		default:
+		}
+
+		if count%progressInterval == 0 {
+			emitter.Emit(TypeProgress, Progress{Elapsed: time.Now().Sub(startTime)})
+		}
+
+		match := number.FindStringSubmatch(filename)
+		if match == nil {
+			return nil
+		}
+
+		baseNum, err := strconv.ParseUint(match[1], 10, 32)
+		if err != nil {
+			return nil
+		}
+
+		baseNum32 := uint32(baseNum)
+		if baseNum32 < walkBase {
+			return nil
+		}
+		if bounded && baseNum32 > stopBase {
+			return dstore.StopIteration
+		}
+
+		count++
+		run := blockRun{start: baseNum32, end: baseNum32 + bundleSize - 1}
+
+		valid := true
+		if c.Deep {
+			if count == 1 || baseNum32 != previousBase+bundleSize {
+				previous = nil
+			}
+			previousBase = baseNum32
+
+			var problems []string
+			problems, previous = validateBlocksFile(blocksStore, filename, baseNum32, bundleSize, previous)
+			if len(problems) > 0 {
+				tracker.addInvalid(run, "invalid file: "+strings.Join(problems, "; "))
+				valid = false
+			}
+		}
+
+		if valid {
+			tracker.add(run)
+		}
+
+		if count%10000 == 0 {
+			tracker.flushValid()
+		}
+
+		if count%progressInterval == 0 {
+			checkpoint := tracker.checkpoint()
+			checkpoint.Counters = map[string]uint64{"files": uint64(count)}
+			if previous != nil {
+				checkpoint.LastBlockNum = previous.num
+				checkpoint.LastBlockIDs = previous.ids
+			}
+			c.save(checkpoint)
+		}
+
+		return nil
+	})
+	if err != nil && err != dstore.StopIteration {
+		return fmt.Errorf("walking blocks store: %s", err)
+	}
+
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	tracker.finish(startBase, c.StopBlock, bounded)
+	zlog.Info("block holes - completed")
+
+	return nil
+}
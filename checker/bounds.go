@@ -0,0 +1,71 @@
+package checker
+
+import (
+	"fmt"
+	"math"
+
+	bt "cloud.google.com/go/bigtable"
+)
+
+// Every scan accepts a `StartBlock` and a `StopBlock`, both inclusive. A
+// zero `StopBlock` means the scan is not bounded on its upper end.
+
+func inBounds(blockNum, startBlock, stopBlock uint32) bool {
+	if blockNum < startBlock {
+		return false
+	}
+
+	return stopBlock == 0 || blockNum <= stopBlock
+}
+
+// filenamePrefix returns the longest prefix shared by the 10 digits, zero
+// padded, base block number of all the files between `startBase` and
+// `stopBase`, so a store walk can skip everything outside of the range.
+func filenamePrefix(startBase, stopBase uint32, bounded bool) string {
+	if !bounded {
+		return ""
+	}
+
+	start := fmt.Sprintf("%010d", startBase)
+	stop := fmt.Sprintf("%010d", stopBase)
+
+	i := 0
+	for i < len(start) && start[i] == stop[i] {
+		i++
+	}
+
+	return start[:i]
+}
+
+// eosBlocksRowRange returns the EOS blocks table row range holding blocks
+// `startBlock` through `stopBlock`. Row keys start with the 8 hex chars
+// of `math.MaxUint32 - blockNum`, so higher blocks come first.
+func eosBlocksRowRange(startBlock, stopBlock uint32) bt.RowRange {
+	begin := ""
+	if stopBlock != 0 {
+		begin = fmt.Sprintf("%08x", math.MaxUint32-stopBlock)
+	}
+
+	if startBlock == 0 {
+		return bt.InfiniteRange(begin)
+	}
+
+	return bt.NewRange(begin, fmt.Sprintf("%08x", math.MaxUint32-(startBlock-1)))
+}
+
+// ethBlocksRowRange returns the ETH blocks table row range holding blocks
+// `startBlock` through `stopBlock`. Row keys are `blkn:` followed by the
+// 16 hex chars of `math.MaxUint64 - blockNum`, so higher blocks come
+// first.
+func ethBlocksRowRange(startBlock, stopBlock uint32) bt.RowRange {
+	begin := "blkn:"
+	if stopBlock != 0 {
+		begin = fmt.Sprintf("blkn:%016x", math.MaxUint64-uint64(stopBlock))
+	}
+
+	if startBlock == 0 {
+		return bt.NewRange(begin, "blkn;")
+	}
+
+	return bt.NewRange(begin, fmt.Sprintf("blkn:%016x", math.MaxUint64-uint64(startBlock-1)))
+}
@@ -0,0 +1,27 @@
+package checker
+
+import (
+	"context"
+)
+
+// Checker is a single diagnose scan. Its inputs are the fields of the
+// implementing struct, and everything it finds is reported through the
+// emitter as `BlockRange`, `Transaction`, `Progress` and `Message`
+// events. A checker knows nothing about HTTP or websockets, so it can be
+// run from the diagnose server as well as from any other Go tooling.
+type Checker interface {
+	Check(ctx context.Context, emitter Emitter) error
+}
+
+// Emitter receives the events produced by a Checker. The `objType` is one
+// of the `Type*` constants and `obj` its matching payload.
+type Emitter interface {
+	Emit(objType string, obj interface{})
+}
+
+// EmitterFunc adapts a plain function to the Emitter interface.
+type EmitterFunc func(objType string, obj interface{})
+
+func (f EmitterFunc) Emit(objType string, obj interface{}) {
+	f(objType, obj)
+}
@@ -0,0 +1,51 @@
+package checker
+
+// Checkpoint is the state of a scan between two blocks: everything below
+// `NextBlock` was scanned, and every event for it emitted except the valid
+// range opened at `ValidStart`. A scan resumed from a checkpoint emits the
+// same events an uninterrupted scan would have emitted after it.
+type Checkpoint struct {
+	NextBlock  uint32 `json:"nextBlock"`
+	ValidStart uint32 `json:"validStart"`
+	Started    bool   `json:"started"`
+
+	// StopBlock is the upper bound resolved by the scan, so a resumed scan
+	// stops at the same block even if the chain grew in between.
+	StopBlock uint32 `json:"stopBlock,omitempty"`
+
+	// Counters are the check specific totals reported at the end of the
+	// scan.
+	Counters map[string]uint64 `json:"counters,omitempty"`
+
+	// LastBlockNum and LastBlockIDs are the last block read by scans
+	// validating the links between blocks.
+	LastBlockNum uint32   `json:"lastBlockNum,omitempty"`
+	LastBlockIDs []string `json:"lastBlockIds,omitempty"`
+}
+
+// Checkpointing is embedded by the checks able to resume a previous run.
+type Checkpointing struct {
+	// ResumeFrom makes the check continue a previous run from its last
+	// checkpoint instead of starting over.
+	ResumeFrom *Checkpoint
+
+	// OnCheckpoint is called with a new checkpoint at regular intervals,
+	// from the goroutine calling `Check` and in between two events.
+	OnCheckpoint func(checkpoint Checkpoint)
+}
+
+func (c *Checkpointing) Checkpoints() *Checkpointing {
+	return c
+}
+
+func (c *Checkpointing) save(checkpoint Checkpoint) {
+	if c.OnCheckpoint != nil {
+		c.OnCheckpoint(checkpoint)
+	}
+}
+
+// Resumable is implemented by the checks embedding `Checkpointing`.
+type Resumable interface {
+	Checker
+	Checkpoints() *Checkpointing
+}
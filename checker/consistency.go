@@ -0,0 +1,443 @@
+package checker
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	bt "cloud.google.com/go/bigtable"
+	"github.com/eoscanada/dstore"
+	"github.com/eoscanada/kvdb/eosdb"
+	"github.com/eoscanada/kvdb/ethdb"
+	"go.uber.org/zap"
+)
+
+// consistencyWindowSize is the number of blocks compared at once, the
+// block IDs of a whole window are held in memory. It is a multiple of the
+// merged blocks bundle size so a file never spans two windows.
+const consistencyWindowSize = 10000
+
+// kvdbBlock is a KVDB block row along with the expected columns it
+// misses.
+type kvdbBlock struct {
+	id      string
+	missing []string
+}
+
+// EOSBlocksConsistency walks a block range in both the merged blocks store
+// and the EOS KVDB blocks table, and reports the ranges present in one but
+// missing, or partial, in the other. Where both hold a block, the KVDB
+// block IDs must also be found in the merged blocks files, which catches
+// KVDB rows written from a forked branch.
+//
+// Without a `StartBlock`, the range starts at the lowest of the first
+// merged blocks file and the lowest KVDB block.
+type EOSBlocksConsistency struct {
+	BlocksStoreURL string
+	DB             *eosdb.EOSDatabase
+	StartBlock     uint32
+	StopBlock      uint32
+}
+
+func (c *EOSBlocksConsistency) Check(ctx context.Context, emitter Emitter) error {
+	zlog.Info("EOS - blocks store and KVDB consistency",
+		zap.String("block_store_url", c.BlocksStoreURL),
+		zap.Uint32("start_block", c.StartBlock),
+		zap.Uint32("stop_block", c.StopBlock),
+	)
+
+	db := c.DB
+	comparison := &storesComparison{
+		blocksStoreURL: c.BlocksStoreURL,
+		startBlock:     c.StartBlock,
+		stopBlock:      c.StopBlock,
+		headBlock: func(ctx context.Context) (uint32, bool, error) {
+			return eosHeadBlock(ctx, db, c.StartBlock)
+		},
+		blockAtOrBelow: func(ctx context.Context, blockNum uint32) (uint32, bool, error) {
+			return eosBlockAtOrBelow(ctx, db, blockNum)
+		},
+		readKVDB: func(ctx context.Context, startBlock, stopBlock uint32) (map[uint32][]kvdbBlock, error) {
+			return eosReadBlocks(ctx, db, startBlock, stopBlock)
+		},
+	}
+
+	err := comparison.run(ctx, emitter)
+	zlog.Info("EOS - blocks store and KVDB consistency - completed")
+	return err
+}
+
+// ETHBlocksConsistency is the ETH flavor of `EOSBlocksConsistency`.
+type ETHBlocksConsistency struct {
+	BlocksStoreURL string
+	DB             *ethdb.ETHDatabase
+	StartBlock     uint32
+	StopBlock      uint32
+}
+
+func (c *ETHBlocksConsistency) Check(ctx context.Context, emitter Emitter) error {
+	zlog.Info("ETH - blocks store and KVDB consistency",
+		zap.String("block_store_url", c.BlocksStoreURL),
+		zap.Uint32("start_block", c.StartBlock),
+		zap.Uint32("stop_block", c.StopBlock),
+	)
+
+	db := c.DB
+	comparison := &storesComparison{
+		blocksStoreURL: c.BlocksStoreURL,
+		startBlock:     c.StartBlock,
+		stopBlock:      c.StopBlock,
+		headBlock: func(ctx context.Context) (uint32, bool, error) {
+			return ethHeadBlock(ctx, db, c.StartBlock)
+		},
+		blockAtOrBelow: func(ctx context.Context, blockNum uint32) (uint32, bool, error) {
+			return ethBlockAtOrBelow(ctx, db, blockNum)
+		},
+		readKVDB: func(ctx context.Context, startBlock, stopBlock uint32) (map[uint32][]kvdbBlock, error) {
+			return ethReadBlocks(ctx, db, startBlock, stopBlock)
+		},
+	}
+
+	err := comparison.run(ctx, emitter)
+	zlog.Info("ETH - blocks store and KVDB consistency - completed")
+	return err
+}
+
+// storesComparison compares the merged blocks files with the KVDB blocks
+// table, one window of blocks at a time, in ascending block order.
+type storesComparison struct {
+	blocksStoreURL string
+	startBlock     uint32
+	stopBlock      uint32
+
+	// headBlock returns the highest KVDB block at or above `startBlock`.
+	headBlock func(ctx context.Context) (blockNum uint32, found bool, err error)
+
+	// blockAtOrBelow returns the highest KVDB block at or below `blockNum`.
+	blockAtOrBelow func(ctx context.Context, blockNum uint32) (found uint32, ok bool, err error)
+
+	// readKVDB returns the KVDB block rows between `startBlock` and
+	// `stopBlock`, by block number.
+	readKVDB func(ctx context.Context, startBlock, stopBlock uint32) (map[uint32][]kvdbBlock, error)
+
+	started  bool
+	next     uint32
+	fileIDs  map[uint32][]string
+	ranges   *problemRanges
+	windows  int
+	progress func()
+}
+
+func (s *storesComparison) run(ctx context.Context, emitter Emitter) error {
+	bundleSize := MergedBlocksLayout.BundleSize
+	number := regexp.MustCompile(MergedBlocksLayout.FilenamePattern)
+
+	startBase := s.startBlock / bundleSize * bundleSize
+	stopBase := s.stopBlock / bundleSize * bundleSize
+	bounded := s.stopBlock != 0
+
+	zlog.Info("creating blocks store")
+	blocksStore, err := dstore.NewDBinStore(s.blocksStoreURL)
+	if err != nil {
+		return fmt.Errorf("unable to create blocks store: %s", err)
+	}
+
+	startTime := time.Now()
+	s.progress = func() {
+		emitter.Emit(TypeProgress, Progress{Elapsed: time.Now().Sub(startTime)})
+	}
+	s.progress()
+
+	s.fileIDs = map[uint32][]string{}
+	s.ranges = newProblemRanges(emitter)
+	if s.startBlock != 0 {
+		s.started = true
+		s.next = s.startBlock
+	} else {
+		lowest, found, err := s.lowestKVDBBlock(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to find lowest KVDB block: %s", err)
+		}
+		if found {
+			s.started = true
+			s.next = lowest
+		}
+	}
+
+	var compareErr error
+	var lastFileBlock uint32
+	fileCount := 0
+	unreadableCount := 0
+
+	err = blocksStore.Walk(filenamePrefix(startBase, stopBase, bounded), "", func(filename string) error {
+		select {
+		case <-ctx.Done():
+			zlog.Debug("context canceled")
+			return dstore.StopIteration
+		default:
+		}
+
+		match := number.FindStringSubmatch(filename)
+		if match == nil {
+			return nil
+		}
+
+		baseNum, err := strconv.ParseUint(match[1], 10, 32)
+		if err != nil {
+			return nil
+		}
+
+		baseNum32 := uint32(baseNum)
+		if baseNum32 < startBase {
+			return nil
+		}
+		if bounded && baseNum32 > stopBase {
+			return dstore.StopIteration
+		}
+
+		if !s.started {
+			s.started = true
+			s.next = baseNum32
+		}
+
+		// Without a start block, the first merged blocks file may be below
+		// the lowest KVDB block.
+		if s.startBlock == 0 && fileCount == 0 && baseNum32 < s.next {
+			s.next = baseNum32
+		}
+
+		// Every window before the one holding this file is complete.
+		windowStart := baseNum32 / consistencyWindowSize * consistencyWindowSize
+		if windowStart > s.next {
+			if compareErr = s.compareThrough(ctx, windowStart-1); compareErr != nil {
+				return dstore.StopIteration
+			}
+		}
+
+		fileCount++
+		lastFileBlock = baseNum32 + bundleSize - 1
+
+		ids, err := readBlocksFileIDs(blocksStore, filename)
+		if err != nil {
+			unreadableCount++
+			emitter.Emit(TypeMessage, &Message{Msg: fmt.Sprintf("Unreadable merged blocks file %s: %s", filename, err)})
+		}
+		for num, blockIDs := range ids {
+			if num >= s.next && num >= baseNum32 && num <= lastFileBlock {
+				s.fileIDs[num] = append(s.fileIDs[num], blockIDs...)
+			}
+		}
+
+		return nil
+	})
+	if compareErr != nil {
+		return compareErr
+	}
+	if err != nil && err != dstore.StopIteration {
+		return fmt.Errorf("walking blocks store: %s", err)
+	}
+
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	stopBlock := s.stopBlock
+	if !bounded {
+		head, found, err := s.headBlock(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to find head block: %s", err)
+		}
+
+		if !found && fileCount == 0 {
+			emitter.Emit(TypeMessage, &Message{Msg: "No blocks found"})
+			return nil
+		}
+
+		stopBlock = lastFileBlock
+		if found && head > stopBlock {
+			stopBlock = head
+		}
+	}
+
+	if !s.started {
+		s.started = true
+		s.next = s.startBlock
+	}
+
+	if err := s.compareThrough(ctx, stopBlock); err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	s.ranges.flush()
+	emitter.Emit(TypeMessage, &Message{Msg: fmt.Sprintf("Compared %d merged blocks files (%d unreadable) with KVDB: %s", fileCount, unreadableCount, s.ranges.summary())})
+
+	return nil
+}
+
+// lowestKVDBBlock returns the lowest KVDB block. Rows holding the higher
+// blocks first, it is found with a binary search on `blockAtOrBelow`
+// rather than by scanning the whole table.
+func (s *storesComparison) lowestKVDBBlock(ctx context.Context) (uint32, bool, error) {
+	high, found, err := s.blockAtOrBelow(ctx, math.MaxUint32)
+	if err != nil || !found {
+		return 0, false, err
+	}
+
+	low := uint32(0)
+	for low < high {
+		mid := low + (high-low)/2
+		blockNum, found, err := s.blockAtOrBelow(ctx, mid)
+		if err != nil {
+			return 0, false, err
+		}
+
+		if found {
+			high = blockNum
+		} else {
+			low = mid + 1
+		}
+	}
+
+	return high, true, nil
+}
+
+// compareThrough compares every block from `s.next` up to `lastBlock`,
+// one window at a time.
+func (s *storesComparison) compareThrough(ctx context.Context, lastBlock uint32) error {
+	for s.started && uint64(s.next) <= uint64(lastBlock) {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		end := uint64(s.next)/consistencyWindowSize*consistencyWindowSize + consistencyWindowSize - 1
+		if end > uint64(lastBlock) {
+			end = uint64(lastBlock)
+		}
+
+		if err := s.compareWindow(ctx, s.next, uint32(end)); err != nil {
+			return err
+		}
+
+		if end == math.MaxUint32 {
+			s.started = false
+			return nil
+		}
+		s.next = uint32(end) + 1
+	}
+
+	return nil
+}
+
+func (s *storesComparison) compareWindow(ctx context.Context, startBlock, stopBlock uint32) error {
+	kvdbBlocks, err := s.readKVDB(ctx, startBlock, stopBlock)
+	if err != nil {
+		return fmt.Errorf("reading KVDB blocks %d to %d: %s", startBlock, stopBlock, err)
+	}
+
+	for num := uint64(startBlock); num <= uint64(stopBlock); num++ {
+		blockNum := uint32(num)
+		problem, store := compareBlock(s.fileIDs[blockNum], kvdbBlocks[blockNum])
+		s.ranges.add(blockNum, problem, store)
+		delete(s.fileIDs, blockNum)
+	}
+
+	s.windows++
+	if s.windows%100 == 0 {
+		s.ranges.flushValid()
+	}
+	s.progress()
+
+	return nil
+}
+
+// compareBlock returns the problem found with a block given its IDs in the
+// merged blocks files and its KVDB rows, along with the store to rebuild,
+// or an empty problem when both stores agree. The merged blocks files hold
+// forked blocks too, so every KVDB block ID must be found in them but not
+// the other way around. A block missing from both stores is rebuilt in the
+// merged blocks files first, KVDB being loaded from them.
+func compareBlock(fileIDs []string, kvdbBlocks []kvdbBlock) (problem, store string) {
+	switch {
+	case len(fileIDs) == 0 && len(kvdbBlocks) == 0:
+		return "missing in both stores", StoreMergedBlocks
+	case len(kvdbBlocks) == 0:
+		return "missing in KVDB", StoreKVDB
+	case len(fileIDs) == 0:
+		return "missing in merged blocks files", StoreMergedBlocks
+	}
+
+	for _, block := range kvdbBlocks {
+		found := false
+		for _, id := range fileIDs {
+			if normalizeBlockID(id) == normalizeBlockID(block.id) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return "KVDB block ID not found in merged blocks files", StoreKVDB
+		}
+	}
+
+	for _, block := range kvdbBlocks {
+		if len(block.missing) > 0 {
+			return "partial in KVDB, missing " + strings.Join(block.missing, ", "), StoreKVDB
+		}
+	}
+
+	return "", ""
+}
+
+func normalizeBlockID(id string) string {
+	return strings.TrimPrefix(strings.ToLower(id), "0x")
+}
+
+// eosReadBlocks returns the EOS KVDB block rows between `startBlock` and
+// `stopBlock`.
+func eosReadBlocks(ctx context.Context, db *eosdb.EOSDatabase, startBlock, stopBlock uint32) (map[uint32][]kvdbBlock, error) {
+	out := map[uint32][]kvdbBlock{}
+	err := db.Blocks.BaseTable.ReadRows(ctx, eosBlocksRowRange(startBlock, stopBlock), func(row bt.Row) bool {
+		blockNum := eosBlockNum(row)
+		out[blockNum] = append(out[blockNum], kvdbBlock{id: eosBlockID(row, blockNum), missing: eosMissingColumns(db, row)})
+		return true
+	}, bt.RowFilter(bt.StripValueFilter()))
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// ethReadBlocks returns the ETH KVDB block rows between `startBlock` and
+// `stopBlock`, the block hash following the block number in row keys.
+func ethReadBlocks(ctx context.Context, db *ethdb.ETHDatabase, startBlock, stopBlock uint32) (map[uint32][]kvdbBlock, error) {
+	out := map[uint32][]kvdbBlock{}
+
+	var keyErr error
+	err := db.Blocks.BaseTable.ReadRows(ctx, ethBlocksRowRange(startBlock, stopBlock), func(row bt.Row) bool {
+		blockNum, hash, err := ethdb.Keys.ReadBlockNum(row.Key())
+		if err != nil {
+			keyErr = fmt.Errorf("invalid block row key %q: %s", row.Key(), err)
+			return false
+		}
+
+		out[uint32(blockNum)] = append(out[uint32(blockNum)], kvdbBlock{id: hash, missing: ethMissingColumns(db, row)})
+		return true
+	}, bt.RowFilter(bt.StripValueFilter()))
+	if err != nil {
+		return nil, err
+	}
+	if keyErr != nil {
+		return nil, keyErr
+	}
+
+	return out, nil
+}
@@ -0,0 +1,332 @@
+package checker
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	bt "cloud.google.com/go/bigtable"
+	"github.com/eoscanada/kvdb/eosdb"
+	"github.com/eoscanada/kvdb/ethdb"
+	"github.com/eoscanada/kvdb/pbcodec"
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+)
+
+// EOSKVDBForks reports every height of the EOS KVDB blocks table holding
+// more than one block, along with which ones are irreversible. When a
+// single block of the height is irreversible, it is the canonical one and
+// the transaction refs of the other blocks are looked up in the
+// transactions table: forked transactions still found there are orphans.
+// Without a single canonical block, the refs of every block are looked up.
+// Heights with more than one irreversible block, or with none below the
+// last irreversible block, are problems on their own.
+type EOSKVDBForks struct {
+	DB         *eosdb.EOSDatabase
+	StartBlock uint32
+	StopBlock  uint32
+}
+
+func (c *EOSKVDBForks) Check(ctx context.Context, emitter Emitter) error {
+	zlog.Info("EOS - KVDB Forks", zap.Uint32("start_block", c.StartBlock), zap.Uint32("stop_block", c.StopBlock))
+
+	db := c.DB
+	scan := &forkScan{
+		readRows: func(ctx context.Context, f func(blockNum uint32, id string, irreversible bool)) error {
+			return eosReadIrreversibility(ctx, db, c.StartBlock, c.StopBlock, f)
+		},
+		inspect: func(ctx context.Context, fork *Fork, canonical int) error {
+			return eosInspectFork(ctx, db, fork, canonical)
+		},
+	}
+
+	err := scan.run(ctx, emitter)
+	zlog.Info("EOS - KVDB Forks - completed")
+	return err
+}
+
+// ETHKVDBForks is the ETH flavor of `EOSKVDBForks`. ETH transaction rows
+// are keyed by block number and not by block hash, so only transactions
+// absent from the canonical block are counted as orphans.
+type ETHKVDBForks struct {
+	DB         *ethdb.ETHDatabase
+	StartBlock uint32
+	StopBlock  uint32
+}
+
+func (c *ETHKVDBForks) Check(ctx context.Context, emitter Emitter) error {
+	zlog.Info("ETH - KVDB Forks", zap.Uint32("start_block", c.StartBlock), zap.Uint32("stop_block", c.StopBlock))
+
+	db := c.DB
+	scan := &forkScan{
+		readRows: func(ctx context.Context, f func(blockNum uint32, id string, irreversible bool)) error {
+			return ethReadIrreversibility(ctx, db, c.StartBlock, c.StopBlock, f)
+		},
+		inspect: func(ctx context.Context, fork *Fork, canonical int) error {
+			return ethInspectFork(ctx, db, fork, canonical)
+		},
+	}
+
+	err := scan.run(ctx, emitter)
+	zlog.Info("ETH - KVDB Forks - completed")
+	return err
+}
+
+// forkScan finds the heights holding more than one block row, then
+// inspects each of them.
+type forkScan struct {
+	// readRows calls `f` with every block row of the range, in descending
+	// block order.
+	readRows func(ctx context.Context, f func(blockNum uint32, id string, irreversible bool)) error
+
+	// inspect fills the transaction ref counts of the fork's blocks, the
+	// orphan transactions being counted for all but the `canonical` one,
+	// for all of them when `canonical` is -1.
+	inspect func(ctx context.Context, fork *Fork, canonical int) error
+}
+
+func (s *forkScan) run(ctx context.Context, emitter Emitter) error {
+	startTime := time.Now()
+	emitter.Emit(TypeProgress, Progress{Elapsed: time.Now().Sub(startTime)})
+
+	var forks []*Fork
+	var current *Fork
+	closeHeight := func() {
+		if current != nil && len(current.Blocks) > 1 {
+			forks = append(forks, current)
+		}
+	}
+
+	// Rows being read in descending order, the first irreversible block
+	// found is the last irreversible block.
+	var lib uint32
+	libFound := false
+
+	rowCount := 0
+	err := s.readRows(ctx, func(blockNum uint32, id string, irreversible bool) {
+		if ctx.Err() != nil {
+			return
+		}
+
+		if irreversible && !libFound {
+			lib, libFound = blockNum, true
+		}
+
+		rowCount++
+		if rowCount%10000 == 0 {
+			emitter.Emit(TypeProgress, Progress{Elapsed: time.Now().Sub(startTime)})
+		}
+
+		if current == nil || current.BlockNum != blockNum {
+			closeHeight()
+			current = &Fork{BlockNum: blockNum}
+		}
+		current.Blocks = append(current.Blocks, ForkBlock{ID: id, Irreversible: irreversible})
+	})
+	if err != nil {
+		return fmt.Errorf("reading block rows: %s", err)
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	closeHeight()
+
+	duplicateIrreversibleCount := 0
+	missingIrreversibleCount := 0
+	orphanForkCount := 0
+	for i := len(forks) - 1; i >= 0; i-- {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		fork := forks[i]
+		canonical := -1
+		irreversibleCount := 0
+		for j, block := range fork.Blocks {
+			if block.Irreversible {
+				canonical = j
+				irreversibleCount++
+			}
+		}
+
+		if irreversibleCount == 1 {
+			fork.Blocks[canonical].Canonical = true
+		} else {
+			canonical = -1
+		}
+
+		if err := s.inspect(ctx, fork, canonical); err != nil {
+			return fmt.Errorf("inspecting fork at block %d: %s", fork.BlockNum, err)
+		}
+
+		var problems []string
+		switch {
+		case irreversibleCount > 1:
+			duplicateIrreversibleCount++
+			problems = append(problems, fmt.Sprintf("%d irreversible blocks", irreversibleCount))
+		case irreversibleCount == 0 && libFound && fork.BlockNum < lib:
+			missingIrreversibleCount++
+			problems = append(problems, fmt.Sprintf("no irreversible block below last irreversible block %d", lib))
+		}
+
+		// Above the last irreversible block, transactions of blocks not yet
+		// irreversible are expected in the transactions table.
+		orphanCount := 0
+		for _, block := range fork.Blocks {
+			orphanCount += block.OrphanTrxCount
+		}
+		if orphanCount > 0 && (canonical != -1 || len(problems) > 0) {
+			orphanForkCount++
+			problems = append(problems, fmt.Sprintf("%d transactions of forked blocks still in transactions table", orphanCount))
+		}
+		fork.Problem = strings.Join(problems, ", ")
+
+		emitter.Emit(TypeFork, fork)
+		emitter.Emit(TypeProgress, Progress{
+			Elapsed:          time.Now().Sub(startTime),
+			TotalIteration:   int32(len(forks)),
+			CurrentIteration: int32(len(forks) - i),
+		})
+	}
+
+	emitter.Emit(TypeMessage, &Message{
+		Msg: fmt.Sprintf("Found %d forked heights over %d block rows, %d with more than one irreversible block, %d without irreversible block below the last irreversible block, %d with orphan transactions", len(forks), rowCount, duplicateIrreversibleCount, missingIrreversibleCount, orphanForkCount),
+	})
+
+	return nil
+}
+
+// eosInspectFork reads the transaction refs of the fork's blocks. EOS
+// transaction rows are keyed by transaction ID and block ID, so a row
+// found for a forked block is an orphan.
+func eosInspectFork(ctx context.Context, db *eosdb.EOSDatabase, fork *Fork, canonical int) error {
+	refs, err := readTransactionRefs(ctx, db.Blocks.BaseTable, eosBlocksRowRange(fork.BlockNum, fork.BlockNum), db.Blocks.ColTransactionRefs, func(row bt.Row) (string, error) {
+		return eosBlockID(row, fork.BlockNum), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range fork.Blocks {
+		block := &fork.Blocks[i]
+		block.TrxRefCount = len(refs[block.ID])
+		if i == canonical || block.TrxRefCount == 0 {
+			continue
+		}
+
+		var keys bt.RowList
+		for _, trxID := range refs[block.ID] {
+			keys = append(keys, eosdb.Keys.PackTrxsKey(trxID, block.ID))
+		}
+
+		if block.OrphanTrxCount, err = countRows(ctx, db.Transactions.BaseTable, keys); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ethInspectFork reads the transaction refs of the fork's blocks. ETH
+// transaction rows are keyed by transaction hash and block number, so a
+// row found for a transaction of a forked block that is not part of the
+// canonical block is an orphan.
+func ethInspectFork(ctx context.Context, db *ethdb.ETHDatabase, fork *Fork, canonical int) error {
+	refs, err := readTransactionRefs(ctx, db.Blocks.BaseTable, ethBlocksRowRange(fork.BlockNum, fork.BlockNum), db.Blocks.ColTrxRefsProto, func(row bt.Row) (string, error) {
+		_, hash, err := ethdb.Keys.ReadBlockNum(row.Key())
+		return hash, err
+	})
+	if err != nil {
+		return err
+	}
+
+	canonicalHashes := map[string]bool{}
+	if canonical != -1 {
+		for _, hash := range refs[fork.Blocks[canonical].ID] {
+			canonicalHashes[hash] = true
+		}
+	}
+
+	for i := range fork.Blocks {
+		block := &fork.Blocks[i]
+		block.TrxRefCount = len(refs[block.ID])
+		if i == canonical || block.TrxRefCount == 0 {
+			continue
+		}
+
+		var keys bt.RowList
+		for _, hash := range refs[block.ID] {
+			if !canonicalHashes[hash] {
+				keys = append(keys, ethdb.Keys.PackTrxKey(hash, uint64(fork.BlockNum)))
+			}
+		}
+
+		if block.OrphanTrxCount, err = countRows(ctx, db.Transactions.BaseTable, keys); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rowReader is the subset of a KVDB table used to read rows.
+type rowReader interface {
+	ReadRows(ctx context.Context, arg bt.RowSet, f func(bt.Row) bool, opts ...bt.ReadOption) error
+}
+
+// readTransactionRefs returns the hex encoded transaction hashes of the
+// `TransactionRefs` held in the refs column of every block row of
+// `rowRange`, by block ID.
+func readTransactionRefs(ctx context.Context, table rowReader, rowRange bt.RowRange, refsColumn string, blockID func(row bt.Row) (string, error)) (map[string][]string, error) {
+	out := map[string][]string{}
+
+	var rowErr error
+	err := table.ReadRows(ctx, rowRange, func(row bt.Row) bool {
+		id, err := blockID(row)
+		if err != nil {
+			rowErr = fmt.Errorf("invalid block row key %q: %s", row.Key(), err)
+			return false
+		}
+
+		for _, items := range row {
+			for _, item := range items {
+				if item.Column != refsColumn {
+					continue
+				}
+
+				refs := &pbcodec.TransactionRefs{}
+				if err := proto.Unmarshal(item.Value, refs); err != nil {
+					rowErr = fmt.Errorf("invalid transaction refs of block %s: %s", id, err)
+					return false
+				}
+
+				hashes := []string{}
+				for _, hash := range refs.Hashes {
+					hashes = append(hashes, hex.EncodeToString(hash))
+				}
+				out[id] = hashes
+			}
+		}
+		return true
+	}, bt.RowFilter(latestColumnFilter(refsColumn)))
+	if err == nil {
+		err = rowErr
+	}
+
+	return out, err
+}
+
+// countRows returns how many of the `keys` rows exist in the table.
+func countRows(ctx context.Context, table rowReader, keys bt.RowList) (count int, err error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	err = table.ReadRows(ctx, keys, func(row bt.Row) bool {
+		count++
+		return true
+	}, bt.RowFilter(bt.ChainFilters(bt.CellsPerRowLimitFilter(1), bt.StripValueFilter())))
+	return
+}
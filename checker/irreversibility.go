@@ -0,0 +1,279 @@
+package checker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	bt "cloud.google.com/go/bigtable"
+	"github.com/eoscanada/kvdb/eosdb"
+	"github.com/eoscanada/kvdb/ethdb"
+	"go.uber.org/zap"
+)
+
+// EOSKVDBIrreversibility reads the irreversible flag of the EOS KVDB block
+// rows and walks the chain down from its head. Every height below the
+// highest irreversible block must hold exactly one irreversible block:
+// reversible or missing blocks below it, and heights holding more than one
+// irreversible block, are reported as holes.
+//
+// Without a `StartBlock`, the range ends at the lowest block row.
+type EOSKVDBIrreversibility struct {
+	DB         *eosdb.EOSDatabase
+	StartBlock uint32
+	StopBlock  uint32
+}
+
+func (c *EOSKVDBIrreversibility) Check(ctx context.Context, emitter Emitter) error {
+	zlog.Info("EOS - KVDB Irreversibility", zap.Uint32("start_block", c.StartBlock), zap.Uint32("stop_block", c.StopBlock))
+
+	db := c.DB
+	scan := &irreversibilityScan{
+		startBlock: c.StartBlock,
+		stopBlock:  c.StopBlock,
+		readRows: func(ctx context.Context, f func(blockNum uint32, id string, irreversible bool)) error {
+			return eosReadIrreversibility(ctx, db, c.StartBlock, c.StopBlock, f)
+		},
+	}
+
+	err := scan.run(ctx, emitter)
+	zlog.Info("EOS - KVDB Irreversibility - completed")
+	return err
+}
+
+// ETHKVDBIrreversibility is the ETH flavor of `EOSKVDBIrreversibility`.
+type ETHKVDBIrreversibility struct {
+	DB         *ethdb.ETHDatabase
+	StartBlock uint32
+	StopBlock  uint32
+}
+
+func (c *ETHKVDBIrreversibility) Check(ctx context.Context, emitter Emitter) error {
+	zlog.Info("ETH - KVDB Irreversibility", zap.Uint32("start_block", c.StartBlock), zap.Uint32("stop_block", c.StopBlock))
+
+	db := c.DB
+	scan := &irreversibilityScan{
+		startBlock: c.StartBlock,
+		stopBlock:  c.StopBlock,
+		readRows: func(ctx context.Context, f func(blockNum uint32, id string, irreversible bool)) error {
+			return ethReadIrreversibility(ctx, db, c.StartBlock, c.StopBlock, f)
+		},
+	}
+
+	err := scan.run(ctx, emitter)
+	zlog.Info("ETH - KVDB Irreversibility - completed")
+	return err
+}
+
+const (
+	problemDuplicateIrreversible = "more than one irreversible block at the same height"
+	problemReversibleBelowLIB    = "reversible below last irreversible block"
+	problemMissingBelowLIB       = "missing below last irreversible block"
+	problemMissingBlock          = "missing block"
+)
+
+// irreversibilityScan walks the block rows from the highest block down,
+// the first irreversible block found being the last irreversible block.
+type irreversibilityScan struct {
+	startBlock uint32
+	stopBlock  uint32
+
+	// readRows calls `f` with every block row between `startBlock` and
+	// `stopBlock`, in descending block order.
+	readRows func(ctx context.Context, f func(blockNum uint32, id string, irreversible bool)) error
+}
+
+// irreversibilityRun is a run of contiguous blocks sharing the same
+// problem, an empty problem being a valid run.
+type irreversibilityRun struct {
+	start   uint32
+	end     uint32
+	problem string
+}
+
+func (s *irreversibilityScan) run(ctx context.Context, emitter Emitter) error {
+	startTime := time.Now()
+	emitter.Emit(TypeProgress, Progress{Elapsed: time.Now().Sub(startTime)})
+
+	var runs []irreversibilityRun
+	add := func(start, end uint32, problem string) {
+		if n := len(runs); n > 0 {
+			last := &runs[n-1]
+			if last.problem == problem && end+1 == last.start {
+				last.start = start
+				return
+			}
+		}
+		runs = append(runs, irreversibilityRun{start: start, end: end, problem: problem})
+	}
+
+	var libFound bool
+	var lib uint32
+	belowLIB := func(problemAbove, problemBelow string) string {
+		if libFound {
+			return problemBelow
+		}
+		return problemAbove
+	}
+
+	var started bool
+	var height uint32
+	var irreversibleIDs []string
+	rowCount := 0
+
+	// closeHeight records the problem of the current height once all of its
+	// rows were read.
+	closeHeight := func() {
+		switch {
+		case len(irreversibleIDs) > 1:
+			add(height, height, problemDuplicateIrreversible)
+			emitter.Emit(TypeMessage, &Message{
+				Msg: fmt.Sprintf("Block %d has %d irreversible blocks: %s", height, len(irreversibleIDs), strings.Join(irreversibleIDs, ", ")),
+			})
+		case len(irreversibleIDs) == 1:
+			if !libFound {
+				libFound = true
+				lib = height
+			}
+			add(height, height, "")
+		default:
+			add(height, height, belowLIB("", problemReversibleBelowLIB))
+		}
+	}
+
+	err := s.readRows(ctx, func(blockNum uint32, id string, irreversible bool) {
+		if ctx.Err() != nil {
+			return
+		}
+
+		rowCount++
+		if rowCount%10000 == 0 {
+			emitter.Emit(TypeProgress, Progress{Elapsed: time.Now().Sub(startTime)})
+		}
+
+		if !started {
+			started = true
+			if s.stopBlock != 0 && blockNum < s.stopBlock {
+				add(blockNum+1, s.stopBlock, problemMissingBlock)
+			}
+		} else if blockNum != height {
+			closeHeight()
+			if blockNum+1 < height {
+				add(blockNum+1, height-1, belowLIB(problemMissingBlock, problemMissingBelowLIB))
+			}
+			irreversibleIDs = nil
+		}
+
+		height = blockNum
+		if irreversible {
+			irreversibleIDs = append(irreversibleIDs, id)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("reading block rows: %s", err)
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	if !started {
+		emitter.Emit(TypeMessage, &Message{Msg: "No blocks found"})
+		return nil
+	}
+
+	closeHeight()
+	if s.startBlock != 0 && height > s.startBlock {
+		add(s.startBlock, height-1, belowLIB(problemMissingBlock, problemMissingBelowLIB))
+	}
+
+	ranges := newProblemRanges(emitter)
+	for i := len(runs) - 1; i >= 0; i-- {
+		ranges.addRange(runs[i].start, runs[i].end, runs[i].problem, "")
+	}
+	ranges.flush()
+
+	if libFound {
+		emitter.Emit(TypeMessage, &Message{Msg: fmt.Sprintf("Last irreversible block %d: %s", lib, ranges.summary())})
+	} else {
+		emitter.Emit(TypeMessage, &Message{Msg: fmt.Sprintf("No irreversible block found: %s", ranges.summary())})
+	}
+
+	return nil
+}
+
+// eosReadIrreversibility calls `f` with the ID and irreversible flag of
+// every EOS block row between `startBlock` and `stopBlock`, in descending
+// block order.
+func eosReadIrreversibility(ctx context.Context, db *eosdb.EOSDatabase, startBlock, stopBlock uint32, f func(blockNum uint32, id string, irreversible bool)) error {
+	column := db.Blocks.ColMetaIrreversible
+	return db.Blocks.BaseTable.ReadRows(ctx, eosBlocksRowRange(startBlock, stopBlock), func(row bt.Row) bool {
+		blockNum := eosBlockNum(row)
+		f(blockNum, eosBlockID(row, blockNum), isIrreversible(row, column))
+		return true
+	}, bt.RowFilter(irreversibleFilter(column)))
+}
+
+// ethReadIrreversibility is the ETH flavor of `eosReadIrreversibility`.
+func ethReadIrreversibility(ctx context.Context, db *ethdb.ETHDatabase, startBlock, stopBlock uint32, f func(blockNum uint32, id string, irreversible bool)) error {
+	column := db.Blocks.ColMetaIrreversible
+
+	var keyErr error
+	err := db.Blocks.BaseTable.ReadRows(ctx, ethBlocksRowRange(startBlock, stopBlock), func(row bt.Row) bool {
+		blockNum, hash, err := ethdb.Keys.ReadBlockNum(row.Key())
+		if err != nil {
+			keyErr = fmt.Errorf("invalid block row key %q: %s", row.Key(), err)
+			return false
+		}
+
+		f(uint32(blockNum), hash, isIrreversible(row, column))
+		return true
+	}, bt.RowFilter(irreversibleFilter(column)))
+	if err == nil {
+		err = keyErr
+	}
+	return err
+}
+
+// irreversibleFilter keeps the latest value of the irreversible column,
+// and a single stripped cell so rows without it are still read.
+func irreversibleFilter(familyColumn string) bt.Filter {
+	return bt.InterleaveFilters(
+		latestColumnFilter(familyColumn),
+		bt.ChainFilters(bt.CellsPerRowLimitFilter(1), bt.StripValueFilter()),
+	)
+}
+
+// latestColumnFilter keeps the latest value of a `family:column` column.
+func latestColumnFilter(familyColumn string) bt.Filter {
+	family, column := familyColumn, ""
+	if i := strings.Index(familyColumn, ":"); i >= 0 {
+		family, column = familyColumn[:i], familyColumn[i+1:]
+	}
+
+	return bt.ChainFilters(bt.FamilyFilter("^"+family+"$"), bt.ColumnFilter("^"+column+"$"), bt.LatestNFilter(1))
+}
+
+// isIrreversible returns whether the row's irreversible column is set. The
+// flag is written as a single `0x01` byte, the textual forms are accepted
+// too.
+func isIrreversible(row bt.Row, familyColumn string) bool {
+	for _, items := range row {
+		for _, item := range items {
+			if item.Column != familyColumn {
+				continue
+			}
+
+			value := item.Value
+			if len(value) == 1 && (value[0] == 0x01 || value[0] == '1') {
+				return true
+			}
+			if bytes.Equal(value, []byte("true")) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,298 @@
+package checker
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	bt "cloud.google.com/go/bigtable"
+	"github.com/eoscanada/diagnose/utils"
+	"github.com/eoscanada/kvdb"
+	"github.com/eoscanada/kvdb/eosdb"
+	"github.com/eoscanada/kvdb/ethdb"
+	"go.uber.org/zap"
+)
+
+// EOSKVDBBlocks walks the EOS KVDB blocks table and reports the ranges of
+// missing block rows.
+type EOSKVDBBlocks struct {
+	DB          *eosdb.EOSDatabase
+	StartBlock  uint32
+	StopBlock   uint32
+	Concurrency int
+
+	Checkpointing
+}
+
+func (c *EOSKVDBBlocks) Check(ctx context.Context, emitter Emitter) error {
+	zlog.Info("EOS - KVDB Block Hole Checker", zap.Uint32("start_block", c.StartBlock), zap.Uint32("stop_block", c.StopBlock))
+
+	scan := &parallelBlockScan{
+		startBlock:  c.StartBlock,
+		stopBlock:   c.StopBlock,
+		concurrency: c.Concurrency,
+		holeMessage: "Found block hole",
+		checkpoints: &c.Checkpointing,
+		headBlock: func(ctx context.Context) (uint32, bool, error) {
+			return eosHeadBlock(ctx, c.DB, c.StartBlock)
+		},
+		scanRange: func(ctx context.Context, startBlock, stopBlock uint32) ([]blockRun, error) {
+			return eosScanBlocks(ctx, c.DB, startBlock, stopBlock, nil)
+		},
+	}
+
+	err := scan.run(ctx, emitter)
+	zlog.Info("EOS - KVDB Block Hole Checker - completed")
+	return err
+}
+
+// EOSKVDBBlocksValidation walks the EOS KVDB blocks table and reports the
+// ranges of block rows missing at least one of their expected columns,
+// grouping contiguous rows missing the exact same columns.
+type EOSKVDBBlocksValidation struct {
+	DB          *eosdb.EOSDatabase
+	StartBlock  uint32
+	StopBlock   uint32
+	Concurrency int
+
+	Checkpointing
+}
+
+func (c *EOSKVDBBlocksValidation) Check(ctx context.Context, emitter Emitter) error {
+	zlog.Info("EOS - KVDB Block Validation", zap.Uint32("start_block", c.StartBlock), zap.Uint32("stop_block", c.StopBlock))
+
+	db := c.DB
+	missingColumns := func(row bt.Row) []string {
+		return eosMissingColumns(db, row)
+	}
+
+	scan := &parallelBlockScan{
+		startBlock:  c.StartBlock,
+		stopBlock:   c.StopBlock,
+		concurrency: c.Concurrency,
+		holeMessage: "Found block hole",
+		checkpoints: &c.Checkpointing,
+		headBlock: func(ctx context.Context) (uint32, bool, error) {
+			return eosHeadBlock(ctx, db, c.StartBlock)
+		},
+		scanRange: func(ctx context.Context, startBlock, stopBlock uint32) ([]blockRun, error) {
+			return eosScanBlocks(ctx, db, startBlock, stopBlock, missingColumns)
+		},
+	}
+
+	err := scan.run(ctx, emitter)
+	zlog.Info("EOS - KVDB Block Validation - completed")
+	return err
+}
+
+// ETHKVDBBlocks walks the ETH KVDB blocks table and reports the ranges of
+// missing block rows.
+type ETHKVDBBlocks struct {
+	DB          *ethdb.ETHDatabase
+	StartBlock  uint32
+	StopBlock   uint32
+	Concurrency int
+
+	Checkpointing
+}
+
+func (c *ETHKVDBBlocks) Check(ctx context.Context, emitter Emitter) error {
+	zlog.Info("ETH - KVDB Block Hole Checker", zap.Uint32("start_block", c.StartBlock), zap.Uint32("stop_block", c.StopBlock))
+
+	scan := &parallelBlockScan{
+		startBlock:  c.StartBlock,
+		stopBlock:   c.StopBlock,
+		concurrency: c.Concurrency,
+		holeMessage: "Found block hole",
+		checkpoints: &c.Checkpointing,
+		headBlock: func(ctx context.Context) (uint32, bool, error) {
+			return ethHeadBlock(ctx, c.DB, c.StartBlock)
+		},
+		scanRange: func(ctx context.Context, startBlock, stopBlock uint32) ([]blockRun, error) {
+			return ethScanBlocks(ctx, c.DB, startBlock, stopBlock, nil)
+		},
+	}
+
+	err := scan.run(ctx, emitter)
+	zlog.Info("ETH - KVDB Block Hole Checker - completed")
+	return err
+}
+
+// ETHKVDBBlocksValidation walks the ETH KVDB blocks table and reports the
+// ranges of block rows missing at least one of their expected columns,
+// grouping contiguous rows missing the exact same columns.
+type ETHKVDBBlocksValidation struct {
+	DB          *ethdb.ETHDatabase
+	StartBlock  uint32
+	StopBlock   uint32
+	Concurrency int
+
+	Checkpointing
+}
+
+func (c *ETHKVDBBlocksValidation) Check(ctx context.Context, emitter Emitter) error {
+	zlog.Info("ETH - KVDB Block Validation", zap.Uint32("start_block", c.StartBlock), zap.Uint32("stop_block", c.StopBlock))
+
+	db := c.DB
+	missingColumns := func(row bt.Row) []string {
+		return ethMissingColumns(db, row)
+	}
+
+	scan := &parallelBlockScan{
+		startBlock:  c.StartBlock,
+		stopBlock:   c.StopBlock,
+		concurrency: c.Concurrency,
+		holeMessage: "Found block hole",
+		checkpoints: &c.Checkpointing,
+		headBlock: func(ctx context.Context) (uint32, bool, error) {
+			return ethHeadBlock(ctx, db, c.StartBlock)
+		},
+		scanRange: func(ctx context.Context, startBlock, stopBlock uint32) ([]blockRun, error) {
+			return ethScanBlocks(ctx, db, startBlock, stopBlock, missingColumns)
+		},
+	}
+
+	err := scan.run(ctx, emitter)
+	zlog.Info("ETH - KVDB Block Validation - completed")
+	return err
+}
+
+func eosBlockNum(row bt.Row) uint32 {
+	return math.MaxUint32 - kvdb.BlockNum(row.Key())
+}
+
+// eosBlockID returns the ID of the block stored in an EOS block row. Row
+// keys are the block ID with its first 8 chars, the block number, replaced
+// by the ones of `math.MaxUint32 - blockNum`.
+func eosBlockID(row bt.Row, blockNum uint32) string {
+	key := row.Key()
+	if len(key) < 8 {
+		return key
+	}
+
+	return fmt.Sprintf("%08x", blockNum) + key[8:]
+}
+
+// eosMissingColumns returns the expected columns absent from an EOS block
+// row.
+func eosMissingColumns(db *eosdb.EOSDatabase, row bt.Row) []string {
+	return utils.MissingColumns(row, db.Blocks.ColBlock, db.Blocks.ColMetaIrreversible, db.Blocks.ColMetaWritten, db.Blocks.ColTransactionRefs, db.Blocks.ColTransactionTraceRefs)
+}
+
+func eosHeadBlock(ctx context.Context, db *eosdb.EOSDatabase, startBlock uint32) (head uint32, found bool, err error) {
+	err = db.Blocks.BaseTable.ReadRows(ctx, eosBlocksRowRange(startBlock, 0), func(row bt.Row) bool {
+		head = eosBlockNum(row)
+		found = true
+		return false
+	}, bt.RowFilter(bt.StripValueFilter()), bt.LimitRows(1))
+	return
+}
+
+// eosBlockAtOrBelow returns the highest block at or below `blockNum`
+// having a row.
+func eosBlockAtOrBelow(ctx context.Context, db *eosdb.EOSDatabase, blockNum uint32) (found uint32, ok bool, err error) {
+	rowRange := bt.InfiniteRange(fmt.Sprintf("%08x", math.MaxUint32-blockNum))
+	err = db.Blocks.BaseTable.ReadRows(ctx, rowRange, func(row bt.Row) bool {
+		found, ok = eosBlockNum(row), true
+		return false
+	}, bt.RowFilter(bt.StripValueFilter()), bt.LimitRows(1))
+	return
+}
+
+// eosScanBlocks returns the runs of blocks between `startBlock` and
+// `stopBlock` having a row, along with the columns `missingColumns`
+// reports as absent from them. A nil `missingColumns` accepts any row.
+func eosScanBlocks(ctx context.Context, db *eosdb.EOSDatabase, startBlock, stopBlock uint32, missingColumns func(row bt.Row) []string) ([]blockRun, error) {
+	runs := &descendingRuns{}
+	err := db.Blocks.BaseTable.ReadRows(ctx, eosBlocksRowRange(startBlock, stopBlock), func(row bt.Row) bool {
+		var missing []string
+		if missingColumns != nil {
+			missing = missingColumns(row)
+		}
+
+		runs.add(eosBlockNum(row), missing)
+		return true
+	}, bt.RowFilter(bt.StripValueFilter()))
+	if err != nil {
+		return nil, err
+	}
+
+	return runs.ascending(), nil
+}
+
+func ethBlockNum(row bt.Row) (uint32, error) {
+	blockNum, _, err := ethdb.Keys.ReadBlockNum(row.Key())
+	if err != nil {
+		return 0, fmt.Errorf("invalid block row key %q: %s", row.Key(), err)
+	}
+
+	return uint32(blockNum), nil
+}
+
+// ethMissingColumns returns the expected columns absent from an ETH block
+// row.
+func ethMissingColumns(db *ethdb.ETHDatabase, row bt.Row) []string {
+	return utils.MissingColumns(row, db.Blocks.ColHeaderProto, db.Blocks.ColMetaIrreversible, db.Blocks.ColMetaMapping, db.Blocks.ColMetaWritten, db.Blocks.ColTrxRefsProto, db.Blocks.ColUnclesProto)
+}
+
+func ethHeadBlock(ctx context.Context, db *ethdb.ETHDatabase, startBlock uint32) (head uint32, found bool, err error) {
+	var keyErr error
+	err = db.Blocks.BaseTable.ReadRows(ctx, ethBlocksRowRange(startBlock, 0), func(row bt.Row) bool {
+		head, keyErr = ethBlockNum(row)
+		found = keyErr == nil
+		return false
+	}, bt.RowFilter(bt.StripValueFilter()), bt.LimitRows(1))
+	if err == nil {
+		err = keyErr
+	}
+	return
+}
+
+// ethBlockAtOrBelow returns the highest block at or below `blockNum`
+// having a row.
+func ethBlockAtOrBelow(ctx context.Context, db *ethdb.ETHDatabase, blockNum uint32) (found uint32, ok bool, err error) {
+	rowRange := bt.NewRange(fmt.Sprintf("blkn:%016x", math.MaxUint64-uint64(blockNum)), "blkn;")
+
+	var keyErr error
+	err = db.Blocks.BaseTable.ReadRows(ctx, rowRange, func(row bt.Row) bool {
+		found, keyErr = ethBlockNum(row)
+		ok = keyErr == nil
+		return false
+	}, bt.RowFilter(bt.StripValueFilter()), bt.LimitRows(1))
+	if err == nil {
+		err = keyErr
+	}
+	return
+}
+
+// ethScanBlocks returns the runs of blocks between `startBlock` and
+// `stopBlock` having a row, along with the columns `missingColumns`
+// reports as absent from them. A nil `missingColumns` accepts any row.
+func ethScanBlocks(ctx context.Context, db *ethdb.ETHDatabase, startBlock, stopBlock uint32, missingColumns func(row bt.Row) []string) ([]blockRun, error) {
+	runs := &descendingRuns{}
+
+	var keyErr error
+	err := db.Blocks.BaseTable.ReadRows(ctx, ethBlocksRowRange(startBlock, stopBlock), func(row bt.Row) bool {
+		var blockNum uint32
+		blockNum, keyErr = ethBlockNum(row)
+		if keyErr != nil {
+			return false
+		}
+
+		var missing []string
+		if missingColumns != nil {
+			missing = missingColumns(row)
+		}
+
+		runs.add(blockNum, missing)
+		return true
+	}, bt.RowFilter(bt.StripValueFilter()))
+	if err != nil {
+		return nil, err
+	}
+	if keyErr != nil {
+		return nil, keyErr
+	}
+
+	return runs.ascending(), nil
+}
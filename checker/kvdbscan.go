@@ -0,0 +1,300 @@
+package checker
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/eoscanada/dhammer"
+	"go.uber.org/zap"
+)
+
+const DefaultConcurrency = 8
+
+// minBlocksPerSubRange avoids splitting small ranges in sub-ranges so tiny
+// that the scan is dominated by request overhead.
+const minBlocksPerSubRange = 1000
+
+type subRange struct {
+	startBlock uint32
+	stopBlock  uint32
+}
+
+type subRangeScan struct {
+	subRange
+	runs []blockRun
+}
+
+// parallelBlockScan splits a block range in sub-ranges, scans them
+// concurrently and feeds the runs of good blocks found to a rangeTracker
+// in ascending block order.
+type parallelBlockScan struct {
+	startBlock  uint32
+	stopBlock   uint32
+	concurrency int
+	holeMessage string
+
+	// checkpoints, when set, are saved after every sub-range and the scan
+	// resumes from `ResumeFrom`.
+	checkpoints *Checkpointing
+
+	// headBlock returns the highest block at or above `startBlock`, used as
+	// the upper bound when `stopBlock` is 0. `found` is false when there
+	// are no blocks at all.
+	headBlock func(ctx context.Context) (blockNum uint32, found bool, err error)
+
+	// scanRange returns the runs of good blocks in the sub-range, in
+	// ascending order.
+	scanRange func(ctx context.Context, startBlock, stopBlock uint32) ([]blockRun, error)
+}
+
+func (s *parallelBlockScan) run(ctx context.Context, emitter Emitter) error {
+	tracker := newRangeTracker(emitter, s.holeMessage)
+	if s.startBlock != 0 {
+		tracker.startAt(s.startBlock)
+	}
+
+	// A resumed scan rescans from the first block not yet reported, up to
+	// the head resolved by the interrupted one.
+	scan := *s
+	if s.checkpoints != nil && s.checkpoints.ResumeFrom != nil {
+		checkpoint := s.checkpoints.ResumeFrom
+		tracker.restore(*checkpoint)
+		scan.startBlock = checkpoint.NextBlock
+		scan.stopBlock = checkpoint.StopBlock
+	}
+
+	// Runs of rows missing the same columns are split at sub-range
+	// boundaries, they are merged back before being reported.
+	var pending *blockRun
+	flushPending := func() {
+		if pending == nil {
+			return
+		}
+
+		count := pending.end - pending.start + 1
+		tracker.addInvalid(*pending, fmt.Sprintf("Missing column(s) %s (%d blocks)", strings.Join(pending.missing, ", "), count))
+		emitter.Emit(TypeMissingColumns, &MissingColumns{
+			StartBlock: pending.start,
+			EndBlock:   pending.end,
+			Columns:    pending.missing,
+		})
+		pending = nil
+	}
+
+	saveCheckpoint := func(stopBlock uint32) {
+		// A pending run of rows missing columns is not reported yet, the
+		// checkpoint waits for the next sub-range ending outside of one.
+		if s.checkpoints == nil || pending != nil || !tracker.started {
+			return
+		}
+
+		checkpoint := tracker.checkpoint()
+		checkpoint.StopBlock = stopBlock
+		s.checkpoints.save(checkpoint)
+	}
+
+	stopBlock, found, err := scan.each(ctx, emitter, func(run blockRun) {
+		if pending != nil && run.start == pending.end+1 && stringsEqual(run.missing, pending.missing) {
+			pending.end = run.end
+			return
+		}
+
+		flushPending()
+		if len(run.missing) == 0 {
+			tracker.add(run)
+			return
+		}
+		pending = &run
+	}, saveCheckpoint)
+	if err != nil || !found || ctx.Err() != nil {
+		return err
+	}
+
+	flushPending()
+	tracker.finish(s.startBlock, stopBlock, s.stopBlock != 0)
+	return nil
+}
+
+// each scans the sub-ranges concurrently and calls `f` with every run of
+// good blocks, in ascending block order, then `subRangeDone`, when set,
+// once all the runs of a sub-range were fed. It returns the upper bound of
+// the scan, `found` being false when there were no blocks to scan.
+func (s *parallelBlockScan) each(ctx context.Context, emitter Emitter, f func(run blockRun), subRangeDone func(stopBlock uint32)) (stopBlock uint32, found bool, err error) {
+	startTime := time.Now()
+	emitter.Emit(TypeProgress, Progress{Elapsed: time.Now().Sub(startTime)})
+
+	stopBlock = s.stopBlock
+	if stopBlock == 0 {
+		head, headFound, err := s.headBlock(ctx)
+		if err != nil {
+			return 0, false, fmt.Errorf("unable to find head block: %s", err)
+		}
+
+		if !headFound || head < s.startBlock {
+			emitter.Emit(TypeMessage, &Message{Msg: "No blocks found"})
+			return 0, false, nil
+		}
+		stopBlock = head
+	}
+
+	concurrency := s.concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+
+	subRanges := splitBlockRange(s.startBlock, stopBlock, concurrency*4)
+	zlog.Info("scanning blocks in parallel",
+		zap.Uint32("start_block", s.startBlock),
+		zap.Uint32("stop_block", stopBlock),
+		zap.Int("concurrency", concurrency),
+		zap.Int("sub_range_count", len(subRanges)),
+	)
+
+	processSubRange := func(ctx context.Context, in []interface{}) ([]interface{}, error) {
+		var out []interface{}
+		for _, r := range in {
+			rng := r.(subRange)
+			runs, err := s.scanRange(ctx, rng.startBlock, rng.stopBlock)
+			if err != nil {
+				return nil, fmt.Errorf("scanning blocks %d to %d: %s", rng.startBlock, rng.stopBlock, err)
+			}
+
+			out = append(out, &subRangeScan{subRange: rng, runs: runs})
+		}
+		return out, nil
+	}
+
+	// The hammer outputs results in the order inputs were pushed, which keeps
+	// the runs in ascending block order.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	hammer := dhammer.NewHammer(1, concurrency, processSubRange)
+	hammer.Start(ctx)
+
+	go func() {
+		defer hammer.Close()
+		for _, rng := range subRanges {
+			select {
+			case <-ctx.Done():
+				return
+			case hammer.In <- rng:
+			}
+		}
+	}()
+
+	done := 0
+	for scanInt := range hammer.Out {
+		scan := scanInt.(*subRangeScan)
+		for _, run := range scan.runs {
+			f(run)
+		}
+		if subRangeDone != nil && ctx.Err() == nil {
+			subRangeDone(stopBlock)
+		}
+
+		done++
+		emitter.Emit(TypeProgress, Progress{
+			Elapsed:          time.Now().Sub(startTime),
+			TotalIteration:   int32(len(subRanges)),
+			CurrentIteration: int32(done),
+		})
+	}
+
+	if err := hammer.Err(); err != nil {
+		return stopBlock, true, err
+	}
+
+	return stopBlock, true, nil
+}
+
+// splitBlockRange splits `startBlock` through `stopBlock` in at most
+// `count` ascending sub-ranges of about the same size.
+func splitBlockRange(startBlock, stopBlock uint32, count int) (out []subRange) {
+	total := uint64(stopBlock) - uint64(startBlock) + 1
+	size := total / uint64(count)
+	if total%uint64(count) != 0 {
+		size++
+	}
+	if size < minBlocksPerSubRange {
+		size = minBlocksPerSubRange
+	}
+
+	for start := uint64(startBlock); start <= uint64(stopBlock); start += size {
+		stop := start + size - 1
+		if stop > uint64(stopBlock) {
+			stop = uint64(stopBlock)
+		}
+		out = append(out, subRange{startBlock: uint32(start), stopBlock: uint32(stop)})
+	}
+	return
+}
+
+// descendingRuns collects block numbers read in descending order, as
+// KVDB block keys are reversed, into runs of contiguous blocks missing the
+// same columns. Rows sharing the same block number are collapsed, keeping
+// the row missing the fewest columns.
+type descendingRuns struct {
+	runs []blockRun
+}
+
+func (r *descendingRuns) add(blockNum uint32, missing []string) {
+	if n := len(r.runs); n > 0 {
+		last := &r.runs[n-1]
+		if blockNum == last.start {
+			if len(missing) >= len(last.missing) {
+				return
+			}
+
+			// A better row at the same height, it replaces the one already
+			// recorded at the start of the last run.
+			if last.start == last.end {
+				r.runs = r.runs[:n-1]
+				r.add(blockNum, missing)
+				return
+			}
+			last.start++
+		} else if blockNum+1 == last.start && stringsEqual(missing, last.missing) {
+			last.start = blockNum
+			return
+		}
+	}
+
+	r.runs = append(r.runs, blockRun{start: blockNum, end: blockNum, missing: missing})
+}
+
+func (r *descendingRuns) ascending() []blockRun {
+	out := make([]blockRun, len(r.runs))
+	for i, run := range r.runs {
+		out[len(r.runs)-1-i] = run
+	}
+	return out
+}
+
+// blockRunSet is a sorted, non overlapping, list of block runs.
+type blockRunSet []blockRun
+
+func (s *blockRunSet) add(run blockRun) {
+	*s = append(*s, run)
+}
+
+func (s blockRunSet) contains(blockNum uint32) bool {
+	i := sort.Search(len(s), func(i int) bool { return s[i].end >= blockNum })
+	return i < len(s) && s[i].start <= blockNum
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
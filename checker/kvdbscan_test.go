@@ -0,0 +1,250 @@
+package checker
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestDescendingRuns(t *testing.T) {
+	type row struct {
+		blockNum uint32
+		missing  []string
+	}
+
+	tests := []struct {
+		name     string
+		rows     []row
+		expected []blockRun
+	}{
+		{
+			name:     "contiguous blocks",
+			rows:     []row{{5, nil}, {4, nil}, {3, nil}},
+			expected: []blockRun{{start: 3, end: 5}},
+		},
+		{
+			name:     "gap between blocks",
+			rows:     []row{{9, nil}, {8, nil}, {5, nil}, {4, nil}},
+			expected: []blockRun{{start: 4, end: 5}, {start: 8, end: 9}},
+		},
+		{
+			name: "blocks missing columns",
+			rows: []row{{5, nil}, {4, []string{"a"}}, {3, []string{"a"}}, {2, []string{"b"}}, {1, nil}},
+			expected: []blockRun{
+				{start: 1, end: 1},
+				{start: 2, end: 2, missing: []string{"b"}},
+				{start: 3, end: 4, missing: []string{"a"}},
+				{start: 5, end: 5},
+			},
+		},
+		{
+			name:     "better row at the same height",
+			rows:     []row{{5, []string{"a"}}, {5, nil}, {4, nil}},
+			expected: []blockRun{{start: 4, end: 5}},
+		},
+		{
+			name:     "worse row at the same height",
+			rows:     []row{{5, nil}, {5, []string{"a"}}, {4, nil}},
+			expected: []blockRun{{start: 4, end: 5}},
+		},
+		{
+			name: "better row at the start of a run",
+			rows: []row{{6, []string{"a"}}, {5, []string{"a"}}, {5, nil}, {4, nil}},
+			expected: []blockRun{
+				{start: 4, end: 5},
+				{start: 6, end: 6, missing: []string{"a"}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runs := &descendingRuns{}
+			for _, row := range test.rows {
+				runs.add(row.blockNum, row.missing)
+			}
+
+			if actual := runs.ascending(); !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("got %+v, expected %+v", actual, test.expected)
+			}
+		})
+	}
+}
+
+func TestSplitBlockRange(t *testing.T) {
+	tests := []struct {
+		name       string
+		startBlock uint32
+		stopBlock  uint32
+		count      int
+		expected   []subRange
+	}{
+		{
+			name:       "smaller than a sub-range",
+			startBlock: 1,
+			stopBlock:  500,
+			count:      8,
+			expected:   []subRange{{1, 500}},
+		},
+		{
+			name:       "sub-ranges of minimum size",
+			startBlock: 0,
+			stopBlock:  2999,
+			count:      32,
+			expected:   []subRange{{0, 999}, {1000, 1999}, {2000, 2999}},
+		},
+		{
+			name:       "even split",
+			startBlock: 1,
+			stopBlock:  8000,
+			count:      4,
+			expected:   []subRange{{1, 2000}, {2001, 4000}, {4001, 6000}, {6001, 8000}},
+		},
+		{
+			name:       "uneven split",
+			startBlock: 0,
+			stopBlock:  10000,
+			count:      4,
+			expected:   []subRange{{0, 2500}, {2501, 5001}, {5002, 7502}, {7503, 10000}},
+		},
+		{
+			name:       "highest blocks",
+			startBlock: math.MaxUint32 - 1499,
+			stopBlock:  math.MaxUint32,
+			count:      2,
+			expected:   []subRange{{math.MaxUint32 - 1499, math.MaxUint32 - 500}, {math.MaxUint32 - 499, math.MaxUint32}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := splitBlockRange(test.startBlock, test.stopBlock, test.count)
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("got %+v, expected %+v", actual, test.expected)
+			}
+		})
+	}
+}
+
+type scanEvent struct {
+	objType string
+	obj     interface{}
+}
+
+func TestParallelBlockScanResume(t *testing.T) {
+	runs := []blockRun{
+		{start: 1, end: 2999},
+		{start: 3200, end: 3999, missing: []string{"meta:written"}},
+		{start: 4000, end: 6500},
+		{start: 6501, end: 7600, missing: []string{"meta:written"}},
+		{start: 7601, end: 9000},
+	}
+
+	tests := []struct {
+		name       string
+		startBlock uint32
+		stopBlock  uint32
+	}{
+		{name: "bounded", startBlock: 1, stopBlock: 10000},
+		{name: "up to head", startBlock: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			type checkpointAt struct {
+				checkpoint Checkpoint
+				eventCount int
+			}
+
+			var events []scanEvent
+			var checkpoints []checkpointAt
+			scan := testBlockScan(test.startBlock, test.stopBlock, 9000, runs, &Checkpointing{
+				OnCheckpoint: func(checkpoint Checkpoint) {
+					checkpoints = append(checkpoints, checkpointAt{checkpoint, len(events)})
+				},
+			})
+			if err := scan.run(context.Background(), recordScanEvents(&events)); err != nil {
+				t.Fatalf("scan: %s", err)
+			}
+
+			if len(checkpoints) < 2 {
+				t.Fatalf("got %d checkpoints, expected at least 2", len(checkpoints))
+			}
+
+			// Up to the head, the chain grew since the interrupted scan, the
+			// resumed one still stops at the same block.
+			resumedRuns := runs
+			if test.stopBlock == 0 {
+				resumedRuns = append(append([]blockRun{}, runs...), blockRun{start: 9001, end: 9500})
+			}
+
+			for _, at := range checkpoints {
+				checkpoint := at.checkpoint
+				resumed := append([]scanEvent{}, events[:at.eventCount]...)
+				scan := testBlockScan(test.startBlock, test.stopBlock, 9500, resumedRuns, &Checkpointing{ResumeFrom: &checkpoint})
+				if err := scan.run(context.Background(), recordScanEvents(&resumed)); err != nil {
+					t.Fatalf("scan resumed at %d: %s", checkpoint.NextBlock, err)
+				}
+
+				if !reflect.DeepEqual(resumed, events) {
+					t.Errorf("scan resumed at %d: got %s, expected %s", checkpoint.NextBlock, formatScanEvents(resumed), formatScanEvents(events))
+				}
+			}
+		})
+	}
+}
+
+// testBlockScan returns a scan of `runs`, each sub-range only seeing the
+// part of the runs it covers.
+func testBlockScan(startBlock, stopBlock, head uint32, runs []blockRun, checkpoints *Checkpointing) *parallelBlockScan {
+	return &parallelBlockScan{
+		startBlock:  startBlock,
+		stopBlock:   stopBlock,
+		concurrency: 2,
+		holeMessage: "hole",
+		checkpoints: checkpoints,
+		headBlock: func(ctx context.Context) (uint32, bool, error) {
+			return head, true, nil
+		},
+		scanRange: func(ctx context.Context, startBlock, stopBlock uint32) (out []blockRun, err error) {
+			for _, run := range runs {
+				if run.end < startBlock || run.start > stopBlock {
+					continue
+				}
+
+				if run.start < startBlock {
+					run.start = startBlock
+				}
+				if run.end > stopBlock {
+					run.end = stopBlock
+				}
+				out = append(out, run)
+			}
+			return out, nil
+		},
+	}
+}
+
+// recordScanEvents returns an emitter appending the reported block ranges
+// and missing columns to `events`, progress and messages being dropped.
+func recordScanEvents(events *[]scanEvent) Emitter {
+	return EmitterFunc(func(objType string, obj interface{}) {
+		if objType == TypeBlockRange || objType == TypeMissingColumns {
+			*events = append(*events, scanEvent{objType, obj})
+		}
+	})
+}
+
+func formatScanEvents(events []scanEvent) (out []string) {
+	for _, event := range events {
+		switch obj := event.obj.(type) {
+		case *BlockRange:
+			out = append(out, fmt.Sprintf("%+v", *obj))
+		case *MissingColumns:
+			out = append(out, fmt.Sprintf("%+v", *obj))
+		}
+	}
+	return
+}
@@ -0,0 +1,399 @@
+package checker
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	bt "cloud.google.com/go/bigtable"
+	"github.com/eoscanada/dhammer"
+	"github.com/eoscanada/diagnose/utils"
+	"github.com/eoscanada/kvdb"
+	"github.com/eoscanada/kvdb/eosdb"
+	"github.com/eoscanada/kvdb/ethdb"
+	"go.uber.org/zap"
+)
+
+// EOSKVDBTrxsValidation scans the EOS KVDB transactions table in parallel
+// and streams every transaction row missing its `written` column. Rows are
+// keyed by transaction ID, so `StartBlock` and `StopBlock` filter rows on
+// their block number instead of narrowing the scanned range.
+//
+// With `Orphans`, every transaction row is read instead, written or not,
+// its block is looked up in the blocks table, and only the transactions
+// whose block is missing, not irreversible or has a different block ID
+// are streamed, along with the problem.
+type EOSKVDBTrxsValidation struct {
+	DB         *eosdb.EOSDatabase
+	StartBlock uint32
+	StopBlock  uint32
+	Orphans    bool
+}
+
+func (c *EOSKVDBTrxsValidation) Check(ctx context.Context, emitter Emitter) error {
+	db := c.DB
+	zlog.Info("EOS - KVDB Trx Validation", zap.Uint32("start_block", c.StartBlock), zap.Uint32("stop_block", c.StopBlock))
+
+	startTime := time.Now()
+
+	// Without `Orphans`, only the rows missing their `written` column are
+	// read.
+	filter := bt.ConditionFilter(bt.ColumnFilter("written"), nil, bt.StripValueFilter())
+	if c.Orphans {
+		filter = bt.StripValueFilter()
+	}
+
+	processRowRange := func(ctx context.Context, ranges []interface{}) ([]interface{}, error) {
+		zlog.Info("processing ranges", zap.Int("range_count", len(ranges)), zap.Reflect("ranges", ranges))
+		var results []interface{}
+		var blockIDs []string
+		for _, r := range ranges {
+			rowRange, _ := r.(bt.RowRange)
+			err := db.Transactions.BaseTable.ReadRows(ctx, rowRange, func(row bt.Row) bool {
+				key := row.Key()
+				trxID := key[0:64]
+				blockNum := kvdb.BlockNum(key[65:73])
+				if !inBounds(blockNum, c.StartBlock, c.StopBlock) {
+					return true
+				}
+
+				trx := &Transaction{
+					Prefix:   trxID[0:8],
+					Id:       trxID,
+					BlockNum: blockNum,
+				}
+				if !c.Orphans {
+					trx.Problem = "missing written column"
+				}
+
+				results = append(results, trx)
+				blockIDs = append(blockIDs, key[65:])
+				return true
+			}, bt.RowFilter(filter))
+			if err != nil {
+				return nil, fmt.Errorf("reading transactions: %s", err)
+			}
+		}
+		zlog.Info("finished process ranges", zap.Int("trx_count", len(results)))
+
+		if c.Orphans {
+			return eosOrphanTrxs(ctx, db, results, blockIDs)
+		}
+		return results, nil
+	}
+
+	concurrency := 16
+	zlog.Info("concurrency count", zap.Int("concurrency_count", concurrency))
+
+	rowRanges := createTrxRowSets(concurrency)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	hammer := dhammer.NewHammer(1, len(rowRanges), processRowRange)
+	hammer.Start(ctx)
+	emitter.Emit(TypeProgress, Progress{Elapsed: time.Now().Sub(startTime)})
+
+	for _, rowRange := range rowRanges {
+		emitter.Emit(TypeMessage, &Message{
+			Msg: fmt.Sprintf("Processing group range: start %s", rowRange.String()),
+		})
+	}
+
+	go func() {
+		defer hammer.Close()
+		for _, rowRange := range rowRanges {
+			zlog.Info("pushing in hammer", zap.Reflect("row_range", rowRange.String()))
+			select {
+			case <-ctx.Done():
+				return
+			case hammer.In <- rowRange:
+			}
+		}
+	}()
+
+	for trxInt := range hammer.Out {
+		emitter.Emit(TypeTransaction, trxInt.(*Transaction))
+	}
+
+	if err := hammer.Err(); err != nil {
+		return err
+	}
+
+	zlog.Info("EOS - KVDB Trx Validation - completed")
+	return nil
+}
+
+// orphanBatchSize is the number of transactions whose blocks are looked
+// up at once.
+const orphanBatchSize = 1000
+
+// eosOrphanTrxs returns the transactions whose block, `blockIDs[i]` being
+// the block ID of `trxs[i]`, is missing from the blocks table, is not
+// irreversible or has a different block ID, with their problem set.
+func eosOrphanTrxs(ctx context.Context, db *eosdb.EOSDatabase, trxs []interface{}, blockIDs []string) (out []interface{}, err error) {
+	for start := 0; start < len(trxs); start += orphanBatchSize {
+		end := start + orphanBatchSize
+		if end > len(trxs) {
+			end = len(trxs)
+		}
+
+		problems, err := eosBlockProblems(ctx, db, blockIDs[start:end])
+		if err != nil {
+			return nil, err
+		}
+
+		for i := start; i < end; i++ {
+			if problem := problems[blockIDs[i]]; problem != "" {
+				trx := trxs[i].(*Transaction)
+				trx.Problem = problem
+				out = append(out, trx)
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// eosBlockProblems looks up the blocks in the blocks table and returns the
+// problem found with each of them, by block ID, an empty problem meaning
+// the block is present and irreversible.
+func eosBlockProblems(ctx context.Context, db *eosdb.EOSDatabase, blockIDs []string) (map[string]string, error) {
+	problems := map[string]string{}
+	var keys bt.RowList
+	for _, blockID := range blockIDs {
+		if _, found := problems[blockID]; found {
+			continue
+		}
+		problems[blockID] = "block missing from blocks table"
+
+		if len(blockID) < 8 {
+			continue
+		}
+		keys = append(keys, fmt.Sprintf("%08x", math.MaxUint32-kvdb.BlockNum(blockID))+blockID[8:])
+	}
+
+	column := db.Blocks.ColMetaIrreversible
+	err := db.Blocks.BaseTable.ReadRows(ctx, keys, func(row bt.Row) bool {
+		blockID := eosBlockID(row, eosBlockNum(row))
+		if isIrreversible(row, column) {
+			problems[blockID] = ""
+		} else {
+			problems[blockID] = "block not irreversible"
+		}
+		return true
+	}, bt.RowFilter(irreversibleFilter(column)))
+	if err != nil {
+		return nil, fmt.Errorf("reading blocks: %s", err)
+	}
+
+	// A block absent under its ID may have been replaced by another block at
+	// the same height, e.g. after a fork.
+	otherIDs := map[uint32][]string{}
+	for blockID, problem := range problems {
+		if problem != "block missing from blocks table" {
+			continue
+		}
+
+		num := kvdb.BlockNum(blockID)
+		ids, found := otherIDs[num]
+		if !found {
+			err := db.Blocks.BaseTable.ReadRows(ctx, eosBlocksRowRange(num, num), func(row bt.Row) bool {
+				ids = append(ids, eosBlockID(row, num))
+				return true
+			}, bt.RowFilter(bt.ChainFilters(bt.CellsPerRowLimitFilter(1), bt.StripValueFilter())))
+			if err != nil {
+				return nil, fmt.Errorf("reading block %d: %s", num, err)
+			}
+			otherIDs[num] = ids
+		}
+
+		if len(ids) > 0 {
+			problems[blockID] = fmt.Sprintf("block ID differs from blocks table (%s)", strings.Join(ids, ", "))
+		}
+	}
+
+	return problems, nil
+}
+
+func createTrxRowSets(concurrentReadCount int) []bt.RowRange {
+	letters := "123456789abcdef"
+	if concurrentReadCount > len(letters)+1 {
+		panic(fmt.Errorf("only accepting concurrent <= %d, got %d", len(letters), concurrentReadCount))
+	}
+
+	step := int(math.Ceil(float64(len(letters)) / float64(concurrentReadCount)))
+	startPrefix := ""
+	var endPrefix string
+
+	var rowRanges []bt.RowRange
+
+	for i := 0; i < len(letters); i += step {
+		endPrefix = string(letters[i]) + strings.Repeat("0", 63) + ":"
+		rowRanges = append(rowRanges, bt.NewRange(startPrefix, endPrefix))
+
+		startPrefix = endPrefix
+	}
+
+	// FIXME: Find a way to get up to last possible keys of `a:` set without copying the `prefixSuccessor` method from eosdb
+	//        Hard-coded for now.
+	rowRanges = append(rowRanges, bt.NewRange(startPrefix, strings.Repeat("f", 64)+";"))
+
+	return rowRanges
+}
+
+// ETHKVDBTrxsValidation scans the ETH KVDB transactions table in parallel
+// and streams every transaction row missing its `written` column, or
+// pointing at a block number absent from the blocks table. The blocks
+// table is scanned first, between `StartBlock` and `StopBlock`, and
+// transactions outside of that range are skipped.
+type ETHKVDBTrxsValidation struct {
+	DB          *ethdb.ETHDatabase
+	StartBlock  uint32
+	StopBlock   uint32
+	Concurrency int
+}
+
+func (c *ETHKVDBTrxsValidation) Check(ctx context.Context, emitter Emitter) error {
+	db := c.DB
+	zlog.Info("ETH - KVDB Trx Validation", zap.Uint32("start_block", c.StartBlock), zap.Uint32("stop_block", c.StopBlock))
+
+	emitter.Emit(TypeMessage, &Message{Msg: "Scanning blocks table"})
+
+	var blocks blockRunSet
+	blocksScan := &parallelBlockScan{
+		startBlock:  c.StartBlock,
+		stopBlock:   c.StopBlock,
+		concurrency: c.Concurrency,
+		headBlock: func(ctx context.Context) (uint32, bool, error) {
+			return ethHeadBlock(ctx, db, c.StartBlock)
+		},
+		scanRange: func(ctx context.Context, startBlock, stopBlock uint32) ([]blockRun, error) {
+			return ethScanBlocks(ctx, db, startBlock, stopBlock, nil)
+		},
+	}
+
+	stopBlock, found, err := blocksScan.each(ctx, emitter, blocks.add, nil)
+	if err != nil || ctx.Err() != nil {
+		return err
+	}
+	if !found {
+		stopBlock = c.StopBlock
+	}
+
+	emitter.Emit(TypeMessage, &Message{Msg: fmt.Sprintf("Found %d ranges of blocks, scanning transactions table", len(blocks))})
+
+	startTime := time.Now()
+	var trxCount, unwrittenCount, orphanCount int64
+
+	processRowRange := func(ctx context.Context, ranges []interface{}) ([]interface{}, error) {
+		var results []interface{}
+		for _, r := range ranges {
+			rowRange := r.(bt.RowRange)
+
+			var keyErr error
+			err := db.Transactions.BaseTable.ReadRows(ctx, rowRange, func(row bt.Row) bool {
+				trxHash, num, err := ethdb.Keys.ReadTrxKey(row.Key())
+				if err != nil {
+					keyErr = fmt.Errorf("invalid transaction row key %q: %s", row.Key(), err)
+					return false
+				}
+				blockNum := uint32(num)
+
+				if !inBounds(blockNum, c.StartBlock, stopBlock) {
+					return true
+				}
+				atomic.AddInt64(&trxCount, 1)
+
+				problem := ""
+				switch {
+				case len(utils.MissingColumns(row, db.Transactions.ColMetaWritten)) > 0:
+					atomic.AddInt64(&unwrittenCount, 1)
+					problem = "missing written column"
+				case !blocks.contains(blockNum):
+					atomic.AddInt64(&orphanCount, 1)
+					problem = "block not found in blocks table"
+				default:
+					return true
+				}
+
+				results = append(results, &Transaction{
+					Prefix:   trxHash[0:8],
+					Id:       trxHash,
+					BlockNum: blockNum,
+					Problem:  problem,
+				})
+				return true
+			}, bt.RowFilter(bt.StripValueFilter()))
+			if err != nil {
+				return nil, err
+			}
+			if keyErr != nil {
+				return nil, keyErr
+			}
+		}
+		return results, nil
+	}
+
+	concurrency := c.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+
+	rowRanges := createETHTrxRowRanges(concurrency)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	hammer := dhammer.NewHammer(1, len(rowRanges), processRowRange)
+	hammer.Start(ctx)
+	emitter.Emit(TypeProgress, Progress{Elapsed: time.Now().Sub(startTime)})
+
+	go func() {
+		defer hammer.Close()
+		for _, rowRange := range rowRanges {
+			select {
+			case <-ctx.Done():
+				return
+			case hammer.In <- rowRange:
+			}
+		}
+	}()
+
+	for trxInt := range hammer.Out {
+		emitter.Emit(TypeTransaction, trxInt.(*Transaction))
+	}
+
+	if err := hammer.Err(); err != nil {
+		return err
+	}
+
+	emitter.Emit(TypeProgress, Progress{Elapsed: time.Now().Sub(startTime)})
+	emitter.Emit(TypeMessage, &Message{
+		Msg: fmt.Sprintf("Scanned %d transactions, %d missing written column, %d pointing at a missing block", trxCount, unwrittenCount, orphanCount),
+	})
+	zlog.Info("ETH - KVDB Trx Validation - completed")
+	return nil
+}
+
+// createETHTrxRowRanges splits the `trx:` keyspace in at most `count`
+// ranges on the first hex char of the transaction hash.
+func createETHTrxRowRanges(count int) []bt.RowRange {
+	const hexChars = "0123456789abcdef"
+
+	step := int(math.Ceil(float64(len(hexChars)) / float64(count)))
+	var rowRanges []bt.RowRange
+	for i := 0; i < len(hexChars); i += step {
+		end := "trx;"
+		if i+step < len(hexChars) {
+			end = "trx:" + string(hexChars[i+step])
+		}
+
+		rowRanges = append(rowRanges, bt.NewRange("trx:"+string(hexChars[i]), end))
+	}
+
+	return rowRanges
+}
@@ -0,0 +1,11 @@
+package checker
+
+import (
+	"go.uber.org/zap"
+)
+
+var zlog = zap.NewNop()
+
+func SetLogger(l *zap.Logger) {
+	zlog = l
+}
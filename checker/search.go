@@ -0,0 +1,189 @@
+package checker
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/eoscanada/dstore"
+	"go.uber.org/zap"
+)
+
+var searchShardFilename = regexp.MustCompile(`.*/(\d+)\.bleve\.tar\.(zst|gz)$`)
+
+// SearchHoles walks the `shards-<ShardSize>/` prefix of the search
+// indexes store and reports the ranges of missing index shards. With
+// `Deep`, every shard archive is also downloaded, unpacked and opened, and
+// a corrupt shard is reported as its own hole along with the reason.
+//
+// Without a `StartBlock`, the range starts at the first shard found. A
+// checkpoint is saved every thousand shards, or every few dozen with
+// `Deep`.
+type SearchHoles struct {
+	IndexesStoreURL string
+	ShardSize       uint32
+	StartBlock      uint32
+	StopBlock       uint32
+	Deep            bool
+
+	Checkpointing
+}
+
+func (c *SearchHoles) Check(ctx context.Context, emitter Emitter) error {
+	shardSize := c.ShardSize
+	zlog.Info("search indexes",
+		zap.String("indexes_store_url", c.IndexesStoreURL),
+		zap.Uint32("shard_size", shardSize),
+		zap.Uint32("start_block", c.StartBlock),
+		zap.Uint32("stop_block", c.StopBlock),
+		zap.Bool("deep", c.Deep),
+	)
+
+	if shardSize == 0 {
+		return fmt.Errorf("invalid shard size 0")
+	}
+
+	startBase := c.StartBlock / shardSize * shardSize
+	bounded := c.StopBlock != 0
+
+	tracker := newRangeTracker(emitter, "hole found")
+	tracker.clamp(c.StartBlock, c.StopBlock)
+	if c.StartBlock != 0 {
+		tracker.startAt(startBase)
+	}
+
+	zlog.Info("creating indexes store")
+	searchStore, err := dstore.NewSimpleStore(c.IndexesStoreURL)
+	if err != nil {
+		return fmt.Errorf("unable to create indexes store: %s", err)
+	}
+
+	startTime := time.Now()
+	count := 0
+	corruptCount := 0
+	docCount := uint64(0)
+
+	progressInterval := 5000
+	checkpointInterval := 1000
+	if c.Deep {
+		progressInterval = 50
+		checkpointInterval = 50
+	}
+
+	walkStart := c.StartBlock
+	if checkpoint := c.ResumeFrom; checkpoint != nil {
+		tracker.restore(*checkpoint)
+		walkStart = checkpoint.NextBlock
+		count = int(checkpoint.Counters["shards"])
+		corruptCount = int(checkpoint.Counters["corrupt"])
+		docCount = checkpoint.Counters["docs"]
+	}
+
+	emitter.Emit(TypeProgress, Progress{Elapsed: time.Now().Sub(startTime)})
+	err = walkSearchShards(ctx, searchStore, shardSize, walkStart, c.StopBlock, func(baseNum uint32, filename string) error {
+		count++
+		if count%progressInterval == 0 {
+			emitter.Emit(TypeProgress, Progress{Elapsed: time.Now().Sub(startTime)})
+		}
+
+		run := blockRun{start: baseNum, end: baseNum + shardSize - 1}
+		if c.Deep {
+			shardDocCount, err := verifySearchShard(searchStore, filename, baseNum, shardSize)
+			if err != nil {
+				corruptCount++
+				tracker.addInvalid(run, fmt.Sprintf("corrupt shard %s: %s", filename, err))
+			} else {
+				docCount += shardDocCount
+				tracker.add(run)
+			}
+		} else {
+			tracker.add(run)
+		}
+
+		if count%1000 == 0 {
+			tracker.flushValid()
+		}
+
+		if count%checkpointInterval == 0 {
+			checkpoint := tracker.checkpoint()
+			checkpoint.Counters = map[string]uint64{
+				"shards":  uint64(count),
+				"corrupt": uint64(corruptCount),
+				"docs":    docCount,
+			}
+			c.save(checkpoint)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	tracker.finish(startBase, c.StopBlock, bounded)
+	if c.Deep {
+		emitter.Emit(TypeMessage, &Message{
+			Msg: fmt.Sprintf("Verified %d shards, %d corrupt, %d documents in valid shards", count, corruptCount, docCount),
+		})
+	}
+	zlog.Info("search indexes - completed")
+
+	return nil
+}
+
+// walkSearchShards calls `f` with the base block number of every shard of
+// size `shardSize` holding blocks between `startBlock` and `stopBlock`, in
+// ascending order, until `ctx` is done.
+func walkSearchShards(ctx context.Context, store dstore.Store, shardSize, startBlock, stopBlock uint32, f func(baseNum uint32, filename string) error) error {
+	startBase := startBlock / shardSize * shardSize
+	stopBase := stopBlock / shardSize * shardSize
+	bounded := stopBlock != 0
+
+	shardPrefix := fmt.Sprintf("shards-%d/", shardSize)
+
+	var walkErr error
+	err := store.Walk(shardPrefix+filenamePrefix(startBase, stopBase, bounded), "", func(filename string) error {
+		select {
+		case <-ctx.Done():
+			zlog.Debug("context canceled")
+			return dstore.StopIteration
+		default:
+		}
+
+		match := searchShardFilename.FindStringSubmatch(filename)
+		if match == nil {
+			return nil
+		}
+
+		baseNum, err := strconv.ParseUint(match[1], 10, 32)
+		if err != nil {
+			return nil
+		}
+
+		if uint32(baseNum) < startBase {
+			return nil
+		}
+		if bounded && uint32(baseNum) > stopBase {
+			return dstore.StopIteration
+		}
+
+		if walkErr = f(uint32(baseNum), filename); walkErr != nil {
+			return dstore.StopIteration
+		}
+		return nil
+	})
+	if walkErr != nil {
+		return walkErr
+	}
+	if err != nil && err != dstore.StopIteration {
+		return fmt.Errorf("walking %s: %s", shardPrefix, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package checker
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/blevesearch/bleve"
+	"github.com/eoscanada/dstore"
+	"github.com/eoscanada/search"
+	"github.com/klauspost/compress/zstd"
+)
+
+// verifySearchShard downloads and unpacks a `.bleve.tar.zst` or
+// `.bleve.tar.gz` search shard, opens the bleve index it holds and checks
+// the boundary blocks the indexer recorded in it match `baseNum` and
+// `shardSize`, a shard without them being corrupt. It returns the
+// document count of the index, or the reason the shard is corrupt.
+func verifySearchShard(store dstore.Store, filename string, baseNum, shardSize uint32) (docCount uint64, err error) {
+	reader, err := store.OpenObject(filename)
+	if err != nil {
+		return 0, fmt.Errorf("cannot open archive: %s", err)
+	}
+	defer reader.Close()
+
+	var decompressed io.Reader
+	switch {
+	case strings.HasSuffix(filename, ".zst"):
+		decoder, err := zstd.NewReader(reader)
+		if err != nil {
+			return 0, fmt.Errorf("cannot decompress archive: %s", err)
+		}
+		defer decoder.Close()
+		decompressed = decoder
+	case strings.HasSuffix(filename, ".gz"):
+		decoder, err := gzip.NewReader(reader)
+		if err != nil {
+			return 0, fmt.Errorf("cannot decompress archive: %s", err)
+		}
+		defer decoder.Close()
+		decompressed = decoder
+	default:
+		return 0, fmt.Errorf("unknown archive compression")
+	}
+
+	tmpDir, err := ioutil.TempDir("", "diagnose-shard-")
+	if err != nil {
+		return 0, fmt.Errorf("cannot create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	indexPath, err := untarBleveIndex(decompressed, tmpDir)
+	if err != nil {
+		return 0, err
+	}
+
+	index, err := bleve.OpenUsing(indexPath, map[string]interface{}{"read_only": true})
+	if err != nil {
+		return 0, fmt.Errorf("cannot open bleve index: %s", err)
+	}
+	defer index.Close()
+
+	docCount, err = index.DocCount()
+	if err != nil {
+		return 0, fmt.Errorf("cannot count documents: %s", err)
+	}
+
+	internalIndex, _, err := index.Advanced()
+	if err != nil {
+		return docCount, fmt.Errorf("cannot access bleve index: %s", err)
+	}
+
+	start, end, err := (&search.ShardIndex{}).GetBoundaryBlocks(internalIndex)
+	if err != nil {
+		return docCount, fmt.Errorf("missing block range metadata: %s", err)
+	}
+	if start == nil || end == nil {
+		return docCount, fmt.Errorf("missing block range metadata")
+	}
+
+	expectedEnd := uint64(baseNum) + uint64(shardSize) - 1
+	if start.Num() != uint64(baseNum) || end.Num() != expectedEnd {
+		return docCount, fmt.Errorf("block range metadata is %d-%d, expected %d-%d for a %d blocks shard", start.Num(), end.Num(), baseNum, expectedEnd, shardSize)
+	}
+
+	return docCount, nil
+}
+
+// untarBleveIndex extracts the archive in `dir` and returns the path of
+// the directory holding the bleve index, the one with `index_meta.json`.
+func untarBleveIndex(reader io.Reader, dir string) (string, error) {
+	indexPath := ""
+	dataSize := int64(0)
+
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("cannot read archive: %s", err)
+		}
+
+		name := filepath.Clean(header.Name)
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return "", fmt.Errorf("invalid archive entry %q", header.Name)
+		}
+		target := filepath.Join(dir, name)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return "", fmt.Errorf("cannot extract %q: %s", header.Name, err)
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return "", fmt.Errorf("cannot extract %q: %s", header.Name, err)
+			}
+
+			file, err := os.Create(target)
+			if err != nil {
+				return "", fmt.Errorf("cannot extract %q: %s", header.Name, err)
+			}
+			written, err := io.Copy(file, tarReader)
+			file.Close()
+			if err != nil {
+				return "", fmt.Errorf("truncated archive entry %q: %s", header.Name, err)
+			}
+
+			if filepath.Base(name) == "index_meta.json" {
+				indexPath = filepath.Dir(target)
+			} else {
+				dataSize += written
+			}
+		}
+	}
+
+	if indexPath == "" {
+		return "", fmt.Errorf("no bleve index in archive")
+	}
+	if dataSize == 0 {
+		return "", fmt.Errorf("empty bleve index")
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(indexPath, "index_meta.json"))
+	if err != nil {
+		return "", fmt.Errorf("cannot read index_meta.json: %s", err)
+	}
+
+	var meta struct {
+		Storage string `json:"storage"`
+	}
+	if err := json.Unmarshal(content, &meta); err != nil {
+		return "", fmt.Errorf("invalid index_meta.json: %s", err)
+	}
+	if meta.Storage == "" {
+		return "", fmt.Errorf("index_meta.json has no storage type")
+	}
+
+	return indexPath, nil
+}
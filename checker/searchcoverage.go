@@ -0,0 +1,254 @@
+package checker
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/eoscanada/dstore"
+	"go.uber.org/zap"
+)
+
+// SearchCoverage walks the shards of every size in `ShardSizes` and
+// reports, per block range, which shard sizes cover it. A range covered
+// by no shard size at all is a hole. A range covered by a smaller shard
+// size but missing from a larger one that already has shards above it is
+// also reported as a hole, since the larger shards should have been
+// merged for it.
+type SearchCoverage struct {
+	IndexesStoreURL string
+	ShardSizes      []uint32
+	StartBlock      uint32
+	StopBlock       uint32
+}
+
+type tierRuns struct {
+	shardSize uint32
+	runs      []blockRun
+}
+
+func (t *tierRuns) add(run blockRun) {
+	if n := len(t.runs); n > 0 {
+		last := &t.runs[n-1]
+		if run.end <= last.end {
+			return
+		}
+
+		if run.start <= last.end+1 {
+			last.end = run.end
+			return
+		}
+	}
+
+	t.runs = append(t.runs, run)
+}
+
+func (t *tierRuns) head() (uint32, bool) {
+	if len(t.runs) == 0 {
+		return 0, false
+	}
+	return t.runs[len(t.runs)-1].end, true
+}
+
+func (c *SearchCoverage) Check(ctx context.Context, emitter Emitter) error {
+	zlog.Info("search coverage",
+		zap.String("indexes_store_url", c.IndexesStoreURL),
+		zap.Reflect("shard_sizes", c.ShardSizes),
+		zap.Uint32("start_block", c.StartBlock),
+		zap.Uint32("stop_block", c.StopBlock),
+	)
+
+	shardSizes := append([]uint32{}, c.ShardSizes...)
+	sort.Slice(shardSizes, func(i, j int) bool { return shardSizes[i] < shardSizes[j] })
+	if len(shardSizes) == 0 {
+		return fmt.Errorf("no shard sizes to check")
+	}
+
+	searchStore, err := dstore.NewSimpleStore(c.IndexesStoreURL)
+	if err != nil {
+		return fmt.Errorf("unable to create indexes store: %s", err)
+	}
+
+	startTime := time.Now()
+	emitter.Emit(TypeProgress, Progress{Elapsed: time.Now().Sub(startTime), TotalIteration: int32(len(shardSizes))})
+
+	var tiers []*tierRuns
+	for i, shardSize := range shardSizes {
+		if shardSize == 0 {
+			return fmt.Errorf("invalid shard size 0")
+		}
+
+		tier := &tierRuns{shardSize: shardSize}
+		err := walkSearchShards(ctx, searchStore, shardSize, c.StartBlock, c.StopBlock, func(baseNum uint32, filename string) error {
+			tier.add(blockRun{start: baseNum, end: baseNum + shardSize - 1})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		zlog.Info("walked search shards", zap.Uint32("shard_size", shardSize), zap.Int("run_count", len(tier.runs)))
+		tiers = append(tiers, tier)
+
+		emitter.Emit(TypeProgress, Progress{
+			Elapsed:          time.Now().Sub(startTime),
+			TotalIteration:   int32(len(shardSizes)),
+			CurrentIteration: int32(i + 1),
+		})
+	}
+
+	for _, segment := range coverageSegments(tiers, c.StartBlock, c.StopBlock) {
+		emitter.Emit(TypeBlockRange, segment.blockRange())
+	}
+
+	zlog.Info("search coverage - completed")
+	return nil
+}
+
+type coverageSegment struct {
+	start    uint32
+	end      uint32
+	covering []uint32
+	unmerged []uint32
+}
+
+func (s *coverageSegment) sameAs(other *coverageSegment) bool {
+	return uint32sEqual(s.covering, other.covering) && uint32sEqual(s.unmerged, other.unmerged)
+}
+
+func (s *coverageSegment) blockRange() *BlockRange {
+	if len(s.covering) == 0 {
+		return NewMissingBlockRange(s.start, s.end, "not covered by any shard size")
+	}
+
+	covered := fmt.Sprintf("covered by shards %s", joinUint32s(s.covering))
+	if len(s.unmerged) > 0 {
+		return NewMissingBlockRange(s.start, s.end, fmt.Sprintf("missing from shards %s, %s", joinUint32s(s.unmerged), covered))
+	}
+
+	return NewValidBlockRange(s.start, s.end, covered)
+}
+
+// coverageSegments cuts the block range spanned by all tiers at every run
+// boundary, and merges back adjacent segments covered by the same set of
+// tiers. Before the first run, and after the last one, the range only
+// extends to `startBlock` and `stopBlock` when they are set.
+func coverageSegments(tiers []*tierRuns, startBlock, stopBlock uint32) (out []*coverageSegment) {
+	bounds := map[uint64]bool{}
+	var low, high uint64
+	first := true
+	for _, tier := range tiers {
+		for _, run := range tier.runs {
+			bounds[uint64(run.start)] = true
+			bounds[uint64(run.end)+1] = true
+
+			if first || uint64(run.start) < low {
+				low = uint64(run.start)
+			}
+			if first || uint64(run.end)+1 > high {
+				high = uint64(run.end) + 1
+			}
+			first = false
+		}
+	}
+
+	if startBlock != 0 {
+		bounds[uint64(startBlock)] = true
+		if first || uint64(startBlock) < low {
+			low = uint64(startBlock)
+		}
+	}
+	if stopBlock != 0 {
+		bounds[uint64(stopBlock)+1] = true
+		if first || uint64(stopBlock)+1 > high {
+			high = uint64(stopBlock) + 1
+		}
+	}
+	if len(bounds) == 0 {
+		return nil
+	}
+
+	var sorted []uint64
+	for bound := range bounds {
+		if bound >= low && bound <= high {
+			sorted = append(sorted, bound)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	heads := make([]uint32, len(tiers))
+	hasHead := make([]bool, len(tiers))
+	for i, tier := range tiers {
+		heads[i], hasHead[i] = tier.head()
+	}
+
+	cursors := make([]int, len(tiers))
+	for i := 0; i+1 < len(sorted); i++ {
+		segment := &coverageSegment{start: uint32(sorted[i]), end: uint32(sorted[i+1] - 1)}
+
+		for j, tier := range tiers {
+			for cursors[j] < len(tier.runs) && tier.runs[cursors[j]].end < segment.start {
+				cursors[j]++
+			}
+
+			if cursors[j] < len(tier.runs) && tier.runs[cursors[j]].start <= segment.start {
+				segment.covering = append(segment.covering, tier.shardSize)
+			}
+		}
+
+		if len(segment.covering) > 0 {
+			smallest := segment.covering[0]
+			for j, tier := range tiers {
+				if tier.shardSize <= smallest || !hasHead[j] || heads[j] <= segment.end {
+					continue
+				}
+
+				if !containsUint32(segment.covering, tier.shardSize) {
+					segment.unmerged = append(segment.unmerged, tier.shardSize)
+				}
+			}
+		}
+
+		if n := len(out); n > 0 && out[n-1].end+1 == segment.start && out[n-1].sameAs(segment) {
+			out[n-1].end = segment.end
+			continue
+		}
+		out = append(out, segment)
+	}
+
+	return out
+}
+
+func containsUint32(list []uint32, value uint32) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func uint32sEqual(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func joinUint32s(values []uint32) string {
+	out := make([]string, len(values))
+	for i, v := range values {
+		out[i] = fmt.Sprint(v)
+	}
+	return strings.Join(out, ", ")
+}
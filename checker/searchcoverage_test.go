@@ -0,0 +1,89 @@
+package checker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCoverageSegments(t *testing.T) {
+	tests := []struct {
+		name       string
+		tiers      []*tierRuns
+		startBlock uint32
+		stopBlock  uint32
+		expected   []*coverageSegment
+	}{
+		{
+			name:  "no runs",
+			tiers: []*tierRuns{{shardSize: 200}},
+		},
+		{
+			name:  "gap in a tier",
+			tiers: []*tierRuns{{shardSize: 200, runs: []blockRun{{start: 0, end: 199}, {start: 400, end: 599}}}},
+			expected: []*coverageSegment{
+				{start: 0, end: 199, covering: []uint32{200}},
+				{start: 200, end: 399},
+				{start: 400, end: 599, covering: []uint32{200}},
+			},
+		},
+		{
+			name:       "bounded by start and stop blocks",
+			tiers:      []*tierRuns{{shardSize: 200, runs: []blockRun{{start: 200, end: 399}}}},
+			startBlock: 100,
+			stopBlock:  499,
+			expected: []*coverageSegment{
+				{start: 100, end: 199},
+				{start: 200, end: 399, covering: []uint32{200}},
+				{start: 400, end: 499},
+			},
+		},
+		{
+			name: "adjacent segments merged",
+			tiers: []*tierRuns{
+				{shardSize: 100, runs: []blockRun{{start: 0, end: 99}, {start: 100, end: 199}}},
+			},
+			expected: []*coverageSegment{
+				{start: 0, end: 199, covering: []uint32{100}},
+			},
+		},
+		{
+			name: "larger tier missing shards",
+			tiers: []*tierRuns{
+				{shardSize: 100, runs: []blockRun{{start: 0, end: 599}}},
+				{shardSize: 200, runs: []blockRun{{start: 0, end: 199}, {start: 400, end: 599}}},
+			},
+			expected: []*coverageSegment{
+				{start: 0, end: 199, covering: []uint32{100, 200}},
+				{start: 200, end: 399, covering: []uint32{100}, unmerged: []uint32{200}},
+				{start: 400, end: 599, covering: []uint32{100, 200}},
+			},
+		},
+		{
+			name: "larger tier behind",
+			tiers: []*tierRuns{
+				{shardSize: 100, runs: []blockRun{{start: 0, end: 599}}},
+				{shardSize: 200, runs: []blockRun{{start: 0, end: 399}}},
+			},
+			expected: []*coverageSegment{
+				{start: 0, end: 399, covering: []uint32{100, 200}},
+				{start: 400, end: 599, covering: []uint32{100}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := coverageSegments(test.tiers, test.startBlock, test.stopBlock)
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("got %+v, expected %+v", formatCoverageSegments(actual), formatCoverageSegments(test.expected))
+			}
+		})
+	}
+}
+
+func formatCoverageSegments(segments []*coverageSegment) (out []coverageSegment) {
+	for _, segment := range segments {
+		out = append(out, *segment)
+	}
+	return
+}
@@ -0,0 +1,174 @@
+package checker
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/eoscanada/dstore"
+	"go.uber.org/zap"
+)
+
+// SearchPeerShards joins a snapshot of the search peers with the shards of
+// the indexes store, walking `shards-<size>/` for every shard size served
+// by a peer. For each peer, the advertised ranges without a backing shard
+// archive are holes. For each shard size, the archived ranges served by no
+// ready peer of that size are holes too. Peers with a moving head are only
+// checked up to the last complete shard below their irreversible block,
+// the reversible blocks they serve not being archived yet.
+type SearchPeerShards struct {
+	IndexesStoreURL string
+	Peers           func(ctx context.Context) ([]*SearchTierPeer, error)
+}
+
+func (c *SearchPeerShards) Check(ctx context.Context, emitter Emitter) error {
+	peers, err := c.Peers(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to read search peers: %s", err)
+	}
+
+	zlog.Info("search peer shards",
+		zap.String("indexes_store_url", c.IndexesStoreURL),
+		zap.Int("peer_count", len(peers)),
+	)
+
+	bySize := map[uint32][]*SearchTierPeer{}
+	var shardSizes []uint32
+	for _, peer := range peers {
+		if peer.ShardSize == 0 {
+			emitter.Emit(TypeMessage, &Message{Msg: fmt.Sprintf("peer %s of tier %d advertises no shard size, ignored", peer.Host, peer.Tier)})
+			continue
+		}
+
+		if bySize[peer.ShardSize] == nil {
+			shardSizes = append(shardSizes, peer.ShardSize)
+		}
+		bySize[peer.ShardSize] = append(bySize[peer.ShardSize], peer)
+	}
+	sort.Slice(shardSizes, func(i, j int) bool { return shardSizes[i] < shardSizes[j] })
+
+	if len(shardSizes) == 0 {
+		return fmt.Errorf("no search peer with a shard size found")
+	}
+
+	searchStore, err := dstore.NewSimpleStore(c.IndexesStoreURL)
+	if err != nil {
+		return fmt.Errorf("unable to create indexes store: %s", err)
+	}
+
+	startTime := time.Now()
+	emitter.Emit(TypeProgress, Progress{Elapsed: time.Now().Sub(startTime), TotalIteration: int32(len(shardSizes))})
+
+	for i, shardSize := range shardSizes {
+		archived := &tierRuns{shardSize: shardSize}
+		err := walkSearchShards(ctx, searchStore, shardSize, 0, 0, func(baseNum uint32, filename string) error {
+			archived.add(blockRun{start: baseNum, end: baseNum + shardSize - 1})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		sizePeers := append([]*SearchTierPeer{}, bySize[shardSize]...)
+		sort.SliceStable(sizePeers, func(i, j int) bool { return sizePeers[i].TailBlock < sizePeers[j].TailBlock })
+
+		served := &tierRuns{shardSize: shardSize}
+		for _, peer := range sizePeers {
+			run, ok := peer.archivableRun()
+			if !ok {
+				emitter.Emit(TypeMessage, &Message{Msg: fmt.Sprintf("peer %s of tier %d serves no complete shard yet", peer.Host, peer.Tier)})
+				continue
+			}
+
+			for _, piece := range splitRun(run, archived.runs) {
+				if piece.covered {
+					emitter.Emit(TypeBlockRange, NewValidBlockRange(piece.start, piece.end, fmt.Sprintf("peer %s (tier %d): backed by shards-%d", peer.Host, peer.Tier, shardSize)))
+				} else {
+					blockRange := NewMissingBlockRange(piece.start, piece.end, fmt.Sprintf("peer %s (tier %d): advertised but missing from shards-%d", peer.Host, peer.Tier, shardSize))
+					blockRange.Store = fmt.Sprintf("%s%d", StoreShardsPrefix, shardSize)
+					emitter.Emit(TypeBlockRange, blockRange)
+				}
+			}
+
+			if peer.Ready {
+				served.add(run)
+			}
+		}
+
+		for _, run := range archived.runs {
+			for _, piece := range splitRun(run, served.runs) {
+				if !piece.covered {
+					emitter.Emit(TypeBlockRange, NewMissingBlockRange(piece.start, piece.end, fmt.Sprintf("shards-%d: archived but not served by any ready peer", shardSize)))
+				}
+			}
+		}
+
+		zlog.Info("cross-checked search peers", zap.Uint32("shard_size", shardSize), zap.Int("peer_count", len(sizePeers)), zap.Int("run_count", len(archived.runs)))
+		emitter.Emit(TypeProgress, Progress{
+			Elapsed:          time.Now().Sub(startTime),
+			TotalIteration:   int32(len(shardSizes)),
+			CurrentIteration: int32(i + 1),
+		})
+	}
+
+	zlog.Info("search peer shards - completed")
+	return nil
+}
+
+// archivableRun returns the blocks of the peer that should be found in
+// the shards archive.
+func (p *SearchTierPeer) archivableRun() (blockRun, bool) {
+	end := p.HeadBlock
+	if p.MovingHead {
+		end = p.IrrBlock
+		if uint64(end)+1 < uint64(p.ShardSize) {
+			return blockRun{}, false
+		}
+		end = uint32((uint64(end)+1)/uint64(p.ShardSize)*uint64(p.ShardSize) - 1)
+	}
+
+	if end < p.TailBlock {
+		return blockRun{}, false
+	}
+	return blockRun{start: p.TailBlock, end: end}, true
+}
+
+type runPiece struct {
+	blockRun
+	covered bool
+}
+
+// splitRun cuts `span` into the pieces covered by `runs`, which must be
+// sorted and not overlapping, and the pieces in between.
+func splitRun(span blockRun, runs []blockRun) (pieces []runPiece) {
+	cursor := uint64(span.start)
+	for _, run := range runs {
+		if uint64(run.end) < cursor {
+			continue
+		}
+		if run.start > span.end || cursor > uint64(span.end) {
+			break
+		}
+
+		if uint64(run.start) > cursor {
+			pieces = append(pieces, runPiece{blockRun: blockRun{start: uint32(cursor), end: run.start - 1}})
+			cursor = uint64(run.start)
+		}
+
+		end := run.end
+		if end > span.end {
+			end = span.end
+		}
+		pieces = append(pieces, runPiece{blockRun: blockRun{start: uint32(cursor), end: end}, covered: true})
+		cursor = uint64(end) + 1
+	}
+
+	if cursor <= uint64(span.end) {
+		pieces = append(pieces, runPiece{blockRun: blockRun{start: uint32(cursor), end: span.end}})
+	}
+	return pieces
+}
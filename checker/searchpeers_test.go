@@ -0,0 +1,65 @@
+package checker
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestSplitRun(t *testing.T) {
+	piece := func(start, end uint32, covered bool) runPiece {
+		return runPiece{blockRun: blockRun{start: start, end: end}, covered: covered}
+	}
+
+	tests := []struct {
+		name     string
+		span     blockRun
+		runs     []blockRun
+		expected []runPiece
+	}{
+		{
+			name:     "no runs",
+			span:     blockRun{start: 10, end: 20},
+			expected: []runPiece{piece(10, 20, false)},
+		},
+		{
+			name:     "fully covered",
+			span:     blockRun{start: 10, end: 20},
+			runs:     []blockRun{{start: 0, end: 30}},
+			expected: []runPiece{piece(10, 20, true)},
+		},
+		{
+			name:     "covered in the middle",
+			span:     blockRun{start: 10, end: 20},
+			runs:     []blockRun{{start: 12, end: 14}},
+			expected: []runPiece{piece(10, 11, false), piece(12, 14, true), piece(15, 20, false)},
+		},
+		{
+			name: "runs overlapping the span ends",
+			span: blockRun{start: 10, end: 20},
+			runs: []blockRun{{start: 0, end: 5}, {start: 8, end: 11}, {start: 15, end: 16}, {start: 19, end: 25}, {start: 30, end: 40}},
+			expected: []runPiece{
+				piece(10, 11, true),
+				piece(12, 14, false),
+				piece(15, 16, true),
+				piece(17, 18, false),
+				piece(19, 20, true),
+			},
+		},
+		{
+			name:     "highest blocks",
+			span:     blockRun{start: math.MaxUint32 - 5, end: math.MaxUint32},
+			runs:     []blockRun{{start: math.MaxUint32 - 2, end: math.MaxUint32}},
+			expected: []runPiece{piece(math.MaxUint32-5, math.MaxUint32-3, false), piece(math.MaxUint32-2, math.MaxUint32, true)},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := splitRun(test.span, test.runs)
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("got %+v, expected %+v", actual, test.expected)
+			}
+		})
+	}
+}
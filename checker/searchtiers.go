@@ -0,0 +1,244 @@
+package checker
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// SearchTierPeer is a search peer as announced on dmesh, serving the
+// blocks from `TailBlock` to `HeadBlock` for its tier, out of shards of
+// `ShardSize` blocks.
+type SearchTierPeer struct {
+	Host       string
+	Tier       uint32
+	Ready      bool
+	TailBlock  uint32
+	IrrBlock   uint32
+	HeadBlock  uint32
+	MovingHead bool
+	ShardSize  uint32
+}
+
+// SearchTiers takes a snapshot of the search peers and reports, per tier,
+// the block ranges served by its ready peers, ranges served by a single
+// peer being holes since they have no redundancy. It then reports the
+// ranges served by each set of tiers up to `HeadBlock`, the chain head,
+// ranges served by no tier at all being holes. The live tier is the one
+// whose peers have a moving head, its lag behind the chain head is
+// reported as a message. `HeadBlock` defaults to the highest peer head.
+type SearchTiers struct {
+	Peers     func(ctx context.Context) ([]*SearchTierPeer, error)
+	HeadBlock uint32
+}
+
+func (c *SearchTiers) Check(ctx context.Context, emitter Emitter) error {
+	peers, err := c.Peers(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to read search peers: %s", err)
+	}
+
+	var ready []*SearchTierPeer
+	headBlock := c.HeadBlock
+	for _, peer := range peers {
+		if !peer.Ready {
+			emitter.Emit(TypeMessage, &Message{Msg: fmt.Sprintf("peer %s of tier %d is not ready, ignored", peer.Host, peer.Tier)})
+			continue
+		}
+		if peer.HeadBlock < peer.TailBlock {
+			emitter.Emit(TypeMessage, &Message{Msg: fmt.Sprintf("peer %s of tier %d serves no blocks yet, ignored", peer.Host, peer.Tier)})
+			continue
+		}
+
+		ready = append(ready, peer)
+		if c.HeadBlock == 0 && peer.HeadBlock > headBlock {
+			headBlock = peer.HeadBlock
+		}
+	}
+
+	zlog.Info("search tiers",
+		zap.Int("peer_count", len(peers)),
+		zap.Int("ready_peer_count", len(ready)),
+		zap.Uint32("head_block", headBlock),
+	)
+
+	if len(ready) == 0 {
+		return fmt.Errorf("no ready search peer found")
+	}
+
+	byTier := map[uint32][]*SearchTierPeer{}
+	var tiers []uint32
+	for _, peer := range ready {
+		if byTier[peer.Tier] == nil {
+			tiers = append(tiers, peer.Tier)
+		}
+		byTier[peer.Tier] = append(byTier[peer.Tier], peer)
+	}
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i] < tiers[j] })
+
+	for _, tier := range tiers {
+		for _, segment := range peerSegments(byTier[tier], 0, 0, samePeers) {
+			if ctx.Err() != nil {
+				return nil
+			}
+			emitter.Emit(TypeBlockRange, segment.tierBlockRange(tier))
+		}
+	}
+
+	low := ready[0].TailBlock
+	for _, peer := range ready {
+		if peer.TailBlock < low {
+			low = peer.TailBlock
+		}
+	}
+
+	for _, segment := range peerSegments(ready, low, headBlock, sameTiers) {
+		if ctx.Err() != nil {
+			return nil
+		}
+		emitter.Emit(TypeBlockRange, segment.blockRange())
+	}
+
+	if live, found := liveTierHead(ready); found {
+		if live < headBlock {
+			emitter.Emit(TypeMessage, &Message{Msg: fmt.Sprintf("live tier head at block %d, %d blocks behind the chain head %d", live, headBlock-live, headBlock)})
+		} else {
+			emitter.Emit(TypeMessage, &Message{Msg: fmt.Sprintf("live tier head at block %d, up to date with the chain head", live)})
+		}
+	} else {
+		emitter.Emit(TypeMessage, &Message{Msg: "no live tier found, no ready peer has a moving head"})
+	}
+
+	zlog.Info("search tiers - completed")
+	return nil
+}
+
+// liveTierHead returns the highest head of the ready peers having a moving
+// head.
+func liveTierHead(peers []*SearchTierPeer) (head uint32, found bool) {
+	for _, peer := range peers {
+		if peer.MovingHead && (!found || peer.HeadBlock > head) {
+			head, found = peer.HeadBlock, true
+		}
+	}
+	return
+}
+
+type peerSegment struct {
+	start uint32
+	end   uint32
+	peers []*SearchTierPeer
+}
+
+func (s *peerSegment) hosts() []string {
+	var hosts []string
+	for _, peer := range s.peers {
+		hosts = append(hosts, peer.Host)
+	}
+	return hosts
+}
+
+func (s *peerSegment) tiers() (tiers []uint32) {
+	for _, peer := range s.peers {
+		if !containsUint32(tiers, peer.Tier) {
+			tiers = append(tiers, peer.Tier)
+		}
+	}
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i] < tiers[j] })
+	return tiers
+}
+
+func samePeers(a, b *peerSegment) bool {
+	if len(a.peers) != len(b.peers) {
+		return false
+	}
+	for i := range a.peers {
+		if a.peers[i] != b.peers[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sameTiers(a, b *peerSegment) bool {
+	return uint32sEqual(a.tiers(), b.tiers())
+}
+
+// tierBlockRange reports the segment of a single tier's peers.
+func (s *peerSegment) tierBlockRange(tier uint32) *BlockRange {
+	switch len(s.peers) {
+	case 0:
+		return NewMissingBlockRange(s.start, s.end, fmt.Sprintf("tier %d: not served by any ready peer", tier))
+	case 1:
+		return NewMissingBlockRange(s.start, s.end, fmt.Sprintf("tier %d: served by a single peer %s, no redundancy", tier, s.peers[0].Host))
+	}
+
+	return NewValidBlockRange(s.start, s.end, fmt.Sprintf("tier %d: served by %d peers %s", tier, len(s.peers), strings.Join(s.hosts(), ", ")))
+}
+
+// blockRange reports the segment of the peers of all tiers.
+func (s *peerSegment) blockRange() *BlockRange {
+	tiers := s.tiers()
+	switch len(tiers) {
+	case 0:
+		return NewMissingBlockRange(s.start, s.end, "gap: not served by any tier")
+	case 1:
+		return NewValidBlockRange(s.start, s.end, fmt.Sprintf("served by tier %d", tiers[0]))
+	}
+
+	return NewValidBlockRange(s.start, s.end, fmt.Sprintf("overlap: served by tiers %s", joinUint32s(tiers)))
+}
+
+// peerSegments cuts the block range served by the peers at every peer tail
+// and head, and merges back adjacent segments that are the `same`. The
+// range extends down to `low` and up to `high` when they are set.
+func peerSegments(peers []*SearchTierPeer, low, high uint32, same func(a, b *peerSegment) bool) (out []*peerSegment) {
+	bounds := map[uint64]bool{}
+	lowest, highest := uint64(low), uint64(high)+1
+	if high == 0 {
+		highest = 0
+	}
+	first := low == 0
+	for _, peer := range peers {
+		bounds[uint64(peer.TailBlock)] = true
+		bounds[uint64(peer.HeadBlock)+1] = true
+
+		if first || uint64(peer.TailBlock) < lowest {
+			lowest = uint64(peer.TailBlock)
+		}
+		if uint64(peer.HeadBlock)+1 > highest {
+			highest = uint64(peer.HeadBlock) + 1
+		}
+		first = false
+	}
+	bounds[lowest] = true
+	bounds[highest] = true
+
+	var sorted []uint64
+	for bound := range bounds {
+		if bound >= lowest && bound <= highest {
+			sorted = append(sorted, bound)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	for i := 0; i+1 < len(sorted); i++ {
+		segment := &peerSegment{start: uint32(sorted[i]), end: uint32(sorted[i+1] - 1)}
+		for _, peer := range peers {
+			if peer.TailBlock <= segment.start && peer.HeadBlock >= segment.end {
+				segment.peers = append(segment.peers, peer)
+			}
+		}
+
+		if n := len(out); n > 0 && same(out[n-1], segment) {
+			out[n-1].end = segment.end
+			continue
+		}
+		out = append(out, segment)
+	}
+
+	return out
+}
@@ -0,0 +1,259 @@
+package checker
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// blockRun is a contiguous run of blocks, both ends inclusive. `missing`
+// lists the columns absent from every row of the run, empty for good
+// blocks.
+type blockRun struct {
+	start   uint32
+	end     uint32
+	missing []string
+}
+
+// rangeTracker turns runs of good blocks, fed in ascending block order,
+// into alternating valid and hole `BlockRange` events. A valid range is
+// only emitted once it is closed by a hole or by the end of the scan, so
+// runs split across sub-range boundaries are reported as a single range.
+type rangeTracker struct {
+	emitter     Emitter
+	holeMessage string
+
+	started    bool
+	validStart uint32
+	next       uint32
+
+	// lowest and highest bound the emitted ranges, `highest` being
+	// unbounded when 0.
+	lowest  uint32
+	highest uint32
+}
+
+func newRangeTracker(emitter Emitter, holeMessage string) *rangeTracker {
+	return &rangeTracker{
+		emitter:     emitter,
+		holeMessage: holeMessage,
+	}
+}
+
+// clamp bounds the emitted ranges to `startBlock` through `stopBlock`, for
+// scans fed whole files or shards while the range is not aligned on them.
+// A `stopBlock` of 0 leaves the ranges unbounded.
+func (t *rangeTracker) clamp(startBlock, stopBlock uint32) {
+	t.lowest = startBlock
+	t.highest = stopBlock
+}
+
+// clamped returns `startBlock` through `endBlock` within the bounds set
+// by `clamp`, `ok` being false when nothing is left.
+func (t *rangeTracker) clamped(startBlock, endBlock uint32) (uint32, uint32, bool) {
+	if startBlock < t.lowest {
+		startBlock = t.lowest
+	}
+	if t.highest != 0 && endBlock > t.highest {
+		endBlock = t.highest
+	}
+	return startBlock, endBlock, startBlock <= endBlock
+}
+
+// startAt makes the range start at `blockNum`, so a first run starting
+// after it is preceded by a hole. Without it, the range starts at the
+// first run fed.
+func (t *rangeTracker) startAt(blockNum uint32) {
+	t.started = true
+	t.validStart = blockNum
+	t.next = blockNum
+}
+
+func (t *rangeTracker) add(run blockRun) {
+	if !t.started {
+		t.startAt(run.start)
+	}
+
+	if run.end < t.next {
+		return
+	}
+
+	if run.start > t.next {
+		t.emitValid()
+		t.emitHole(t.next, run.start-1)
+		t.validStart = run.start
+	}
+
+	t.next = run.end + 1
+}
+
+// addInvalid reports `run` as a hole with its own `message`, for blocks
+// that are present but known to be broken.
+func (t *rangeTracker) addInvalid(run blockRun, message string) {
+	if !t.started {
+		t.startAt(run.start)
+	}
+
+	if run.end < t.next {
+		return
+	}
+
+	t.emitValid()
+	if run.start > t.next {
+		t.emitHole(t.next, run.start-1)
+	}
+	if startBlock, endBlock, ok := t.clamped(run.start, run.end); ok {
+		t.emitter.Emit(TypeBlockRange, NewMissingBlockRange(startBlock, endBlock, message))
+	}
+
+	t.next = run.end + 1
+	t.validStart = t.next
+}
+
+// flushValid emits the valid range accumulated so far, so long scans
+// report progress before the next hole is found.
+func (t *rangeTracker) flushValid() {
+	t.emitValid()
+	t.validStart = t.next
+}
+
+// finish closes the pending valid range, and reports everything up to
+// `stopBlock` as a hole when `bounded` is set.
+func (t *rangeTracker) finish(startBlock, stopBlock uint32, bounded bool) {
+	if !t.started {
+		if bounded {
+			t.emitHole(startBlock, stopBlock)
+		}
+		return
+	}
+
+	t.emitValid()
+	if bounded && t.next <= stopBlock {
+		t.emitHole(t.next, stopBlock)
+	}
+	t.validStart = t.next
+}
+
+// checkpoint returns the tracker state, everything below `NextBlock`
+// having been reported except the valid range opened at `ValidStart`.
+func (t *rangeTracker) checkpoint() Checkpoint {
+	return Checkpoint{
+		NextBlock:  t.next,
+		ValidStart: t.validStart,
+		Started:    t.started,
+	}
+}
+
+// restore resumes the tracker from a checkpoint of a previous scan.
+func (t *rangeTracker) restore(checkpoint Checkpoint) {
+	t.started = checkpoint.Started
+	t.validStart = checkpoint.ValidStart
+	t.next = checkpoint.NextBlock
+}
+
+func (t *rangeTracker) emitValid() {
+	if t.next <= t.validStart {
+		return
+	}
+
+	startBlock, endBlock, ok := t.clamped(t.validStart, t.next-1)
+	if !ok {
+		return
+	}
+	t.emitter.Emit(TypeBlockRange, NewValidBlockRange(startBlock, endBlock, fmt.Sprintf("%d blocks", endBlock-startBlock+1)))
+}
+
+func (t *rangeTracker) emitHole(startBlock, endBlock uint32) {
+	startBlock, endBlock, ok := t.clamped(startBlock, endBlock)
+	if !ok {
+		return
+	}
+	t.emitter.Emit(TypeBlockRange, NewMissingBlockRange(startBlock, endBlock, fmt.Sprintf("%s (%d blocks)", t.holeMessage, endBlock-startBlock+1)))
+}
+
+// problemRanges groups contiguous blocks sharing the same problem into
+// `BlockRange` events, an empty problem being a valid range.
+type problemRanges struct {
+	emitter Emitter
+
+	open    bool
+	start   uint32
+	end     uint32
+	problem string
+	store   string
+
+	counts map[string]uint64
+}
+
+func newProblemRanges(emitter Emitter) *problemRanges {
+	return &problemRanges{
+		emitter: emitter,
+		counts:  map[string]uint64{},
+	}
+}
+
+func (r *problemRanges) add(blockNum uint32, problem, store string) {
+	r.addRange(blockNum, blockNum, problem, store)
+}
+
+// addRange adds blocks `start` through `end`, fed in ascending block
+// order, all sharing the same problem found in `store`, if any.
+func (r *problemRanges) addRange(start, end uint32, problem, store string) {
+	r.counts[problem] += uint64(end-start) + 1
+
+	if r.open && problem == r.problem && store == r.store && start == r.end+1 {
+		r.end = end
+		return
+	}
+
+	r.flush()
+	r.open = true
+	r.start = start
+	r.end = end
+	r.problem = problem
+	r.store = store
+}
+
+// flushValid emits the pending range when it is valid, so long scans
+// report progress before the next problem is found.
+func (r *problemRanges) flushValid() {
+	if r.open && r.problem == "" {
+		r.flush()
+	}
+}
+
+func (r *problemRanges) flush() {
+	if !r.open {
+		return
+	}
+	r.open = false
+
+	count := r.end - r.start + 1
+	if r.problem == "" {
+		r.emitter.Emit(TypeBlockRange, NewValidBlockRange(r.start, r.end, fmt.Sprintf("%d blocks", count)))
+		return
+	}
+
+	blockRange := NewMissingBlockRange(r.start, r.end, fmt.Sprintf("%s (%d blocks)", r.problem, count))
+	blockRange.Store = r.store
+	r.emitter.Emit(TypeBlockRange, blockRange)
+}
+
+// summary returns the number of blocks seen, valid and per problem.
+func (r *problemRanges) summary() string {
+	var total uint64
+	var problems []string
+	for problem, count := range r.counts {
+		total += count
+		if problem != "" {
+			problems = append(problems, fmt.Sprintf("%d %s", count, problem))
+		}
+	}
+	sort.Strings(problems)
+
+	msg := fmt.Sprintf("%d blocks, %d valid", total, r.counts[""])
+	if len(problems) > 0 {
+		msg += ", " + strings.Join(problems, ", ")
+	}
+	return msg
+}
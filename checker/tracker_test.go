@@ -0,0 +1,174 @@
+package checker
+
+import (
+	"reflect"
+	"testing"
+)
+
+// recordBlockRanges returns an emitter appending the `BlockRange` events to
+// `ranges`, the other events being dropped.
+func recordBlockRanges(ranges *[]*BlockRange) Emitter {
+	return EmitterFunc(func(objType string, obj interface{}) {
+		if blockRange, ok := obj.(*BlockRange); ok {
+			*ranges = append(*ranges, blockRange)
+		}
+	})
+}
+
+func TestRangeTracker(t *testing.T) {
+	tests := []struct {
+		name     string
+		feed     func(tracker *rangeTracker)
+		expected []*BlockRange
+	}{
+		{
+			name: "contiguous runs",
+			feed: func(tracker *rangeTracker) {
+				tracker.add(blockRun{start: 10, end: 19})
+				tracker.add(blockRun{start: 20, end: 29})
+				tracker.finish(0, 0, false)
+			},
+			expected: []*BlockRange{
+				NewValidBlockRange(10, 29, "20 blocks"),
+			},
+		},
+		{
+			name: "hole between runs",
+			feed: func(tracker *rangeTracker) {
+				tracker.add(blockRun{start: 10, end: 19})
+				tracker.add(blockRun{start: 25, end: 29})
+				tracker.finish(0, 0, false)
+			},
+			expected: []*BlockRange{
+				NewValidBlockRange(10, 19, "10 blocks"),
+				NewMissingBlockRange(20, 24, "hole (5 blocks)"),
+				NewValidBlockRange(25, 29, "5 blocks"),
+			},
+		},
+		{
+			name: "bounded range",
+			feed: func(tracker *rangeTracker) {
+				tracker.startAt(5)
+				tracker.add(blockRun{start: 10, end: 19})
+				tracker.finish(5, 30, true)
+			},
+			expected: []*BlockRange{
+				NewMissingBlockRange(5, 9, "hole (5 blocks)"),
+				NewValidBlockRange(10, 19, "10 blocks"),
+				NewMissingBlockRange(20, 30, "hole (11 blocks)"),
+			},
+		},
+		{
+			name: "bounded range without runs",
+			feed: func(tracker *rangeTracker) {
+				tracker.finish(5, 30, true)
+			},
+			expected: []*BlockRange{
+				NewMissingBlockRange(5, 30, "hole (26 blocks)"),
+			},
+		},
+		{
+			name: "unbounded range without runs",
+			feed: func(tracker *rangeTracker) {
+				tracker.finish(5, 0, false)
+			},
+		},
+		{
+			name: "invalid run",
+			feed: func(tracker *rangeTracker) {
+				tracker.add(blockRun{start: 10, end: 19})
+				tracker.addInvalid(blockRun{start: 22, end: 24}, "broken")
+				tracker.add(blockRun{start: 25, end: 29})
+				tracker.finish(0, 0, false)
+			},
+			expected: []*BlockRange{
+				NewValidBlockRange(10, 19, "10 blocks"),
+				NewMissingBlockRange(20, 21, "hole (2 blocks)"),
+				NewMissingBlockRange(22, 24, "broken"),
+				NewValidBlockRange(25, 29, "5 blocks"),
+			},
+		},
+		{
+			name: "run already seen",
+			feed: func(tracker *rangeTracker) {
+				tracker.add(blockRun{start: 10, end: 19})
+				tracker.add(blockRun{start: 15, end: 19})
+				tracker.finish(0, 0, false)
+			},
+			expected: []*BlockRange{
+				NewValidBlockRange(10, 19, "10 blocks"),
+			},
+		},
+		{
+			name: "flushed valid range",
+			feed: func(tracker *rangeTracker) {
+				tracker.add(blockRun{start: 10, end: 19})
+				tracker.flushValid()
+				tracker.add(blockRun{start: 20, end: 29})
+				tracker.finish(0, 0, false)
+			},
+			expected: []*BlockRange{
+				NewValidBlockRange(10, 19, "10 blocks"),
+				NewValidBlockRange(20, 29, "10 blocks"),
+			},
+		},
+		{
+			name: "clamped to unaligned bounds",
+			feed: func(tracker *rangeTracker) {
+				tracker.clamp(150, 449)
+				tracker.startAt(100)
+				tracker.add(blockRun{start: 200, end: 299})
+				tracker.addInvalid(blockRun{start: 300, end: 399}, "broken")
+				tracker.add(blockRun{start: 400, end: 499})
+				tracker.finish(100, 449, true)
+			},
+			expected: []*BlockRange{
+				NewMissingBlockRange(150, 199, "hole (50 blocks)"),
+				NewValidBlockRange(200, 299, "100 blocks"),
+				NewMissingBlockRange(300, 399, "broken"),
+				NewValidBlockRange(400, 449, "50 blocks"),
+			},
+		},
+		{
+			name: "clamped hole outside of bounds",
+			feed: func(tracker *rangeTracker) {
+				tracker.clamp(150, 0)
+				tracker.startAt(100)
+				tracker.add(blockRun{start: 150, end: 199})
+				tracker.finish(100, 0, false)
+			},
+			expected: []*BlockRange{
+				NewValidBlockRange(150, 199, "50 blocks"),
+			},
+		},
+		{
+			name: "restored from checkpoint",
+			feed: func(tracker *rangeTracker) {
+				tracker.restore(Checkpoint{NextBlock: 20, ValidStart: 10, Started: true})
+				tracker.add(blockRun{start: 20, end: 29})
+				tracker.finish(0, 0, false)
+			},
+			expected: []*BlockRange{
+				NewValidBlockRange(10, 29, "20 blocks"),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var ranges []*BlockRange
+			test.feed(newRangeTracker(recordBlockRanges(&ranges), "hole"))
+
+			if !reflect.DeepEqual(ranges, test.expected) {
+				t.Errorf("got %+v, expected %+v", formatBlockRanges(ranges), formatBlockRanges(test.expected))
+			}
+		})
+	}
+}
+
+func formatBlockRanges(ranges []*BlockRange) (out []BlockRange) {
+	for _, blockRange := range ranges {
+		out = append(out, *blockRange)
+	}
+	return
+}
@@ -0,0 +1,100 @@
+package checker
+
+import (
+	"time"
+)
+
+const (
+	TypeBlockRange  = "BlockRange"
+	TypeTransaction = "Transaction"
+	TypeMessage     = "Message"
+	TypeProgress    = "Progress"
+
+	TypeMissingColumns = "MissingColumns"
+	TypeFork           = "Fork"
+)
+
+const (
+	BlockRangeStatusValid = "valid"
+	BlockRangeStatusHole  = "hole"
+)
+
+// Stores a hole is found in, for the checks comparing more than one. The
+// search shards store is named after its shard size, like `shards-5000`.
+const (
+	StoreMergedBlocks = "merged-blocks"
+	StoreKVDB         = "kvdb"
+	StoreShardsPrefix = "shards-"
+)
+
+// BlockRange is a range of blocks sharing the same status. `Store` is the
+// store to rebuild for a hole found by a check comparing more than one.
+type BlockRange struct {
+	StarBlock uint32 `json:"startBlock"`
+	EndBlock  uint32 `json:"endBlock"`
+	Message   string `json:"message"`
+	Status    string `json:"status"`
+	Store     string `json:"store,omitempty"`
+}
+
+func NewValidBlockRange(startBlock, endBlock uint32, message string) *BlockRange {
+	return &BlockRange{
+		StarBlock: startBlock,
+		EndBlock:  endBlock,
+		Message:   message,
+		Status:    BlockRangeStatusValid,
+	}
+}
+
+func NewMissingBlockRange(startBlock, endBlock uint32, message string) *BlockRange {
+	return &BlockRange{
+		StarBlock: startBlock,
+		EndBlock:  endBlock,
+		Message:   message,
+		Status:    BlockRangeStatusHole,
+	}
+}
+
+type Transaction struct {
+	Prefix   string `json:"prefix"`
+	Id       string `json:"id"`
+	BlockNum uint32 `json:"blockNum"`
+	Problem  string `json:"problem,omitempty"`
+}
+
+// MissingColumns lists the columns absent from every KVDB row of a
+// contiguous range of blocks.
+type MissingColumns struct {
+	StartBlock uint32   `json:"startBlock"`
+	EndBlock   uint32   `json:"endBlock"`
+	Columns    []string `json:"columns"`
+}
+
+// Fork is a height holding more than one block. `Problem` is set when the
+// fork left the KVDB tables inconsistent.
+type Fork struct {
+	BlockNum uint32      `json:"blockNum"`
+	Blocks   []ForkBlock `json:"blocks"`
+	Problem  string      `json:"problem,omitempty"`
+}
+
+// ForkBlock is one of the blocks of a `Fork`. `OrphanTrxCount` counts the
+// transactions of a non canonical block still found in the transactions
+// table.
+type ForkBlock struct {
+	ID             string `json:"id"`
+	Irreversible   bool   `json:"irreversible"`
+	Canonical      bool   `json:"canonical"`
+	TrxRefCount    int    `json:"trxRefCount"`
+	OrphanTrxCount int    `json:"orphanTrxCount"`
+}
+
+type Message struct {
+	Msg string `json:"message"`
+}
+
+type Progress struct {
+	Elapsed          time.Duration `json:"elapsed"`
+	TotalIteration   int32         `json:"totalIteration"`
+	CurrentIteration int32         `json:"currentIteration"`
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eoscanada/diagnose/checker"
+	"go.uber.org/zap"
+)
+
+// checkResult is the JSON document returned by a check served as plain
+// HTTP. Events other than block ranges, messages and progress, like
+// `Transaction` or `Fork`, are kept as they would be sent on a websocket.
+type checkResult struct {
+	Check          string                `json:"check"`
+	Status         string                `json:"status"`
+	Error          string                `json:"error,omitempty"`
+	Duration       string                `json:"duration"`
+	HoleCount      int                   `json:"holeCount"`
+	HoleBlockCount uint64                `json:"holeBlockCount"`
+	ValidRanges    []*checker.BlockRange `json:"validRanges"`
+	Holes          []*checker.BlockRange `json:"holes"`
+	Messages       []string              `json:"messages"`
+	Events         []JobEvent            `json:"events"`
+}
+
+func newCheckResult(name string) *checkResult {
+	return &checkResult{
+		Check:       name,
+		Status:      JobStatusCompleted,
+		ValidRanges: []*checker.BlockRange{},
+		Holes:       []*checker.BlockRange{},
+		Messages:    []string{},
+		Events:      []JobEvent{},
+	}
+}
+
+// checkResultEmitter collects the events of a check into a `checkResult`.
+type checkResultEmitter struct {
+	lock   sync.Mutex
+	result *checkResult
+}
+
+func (e *checkResultEmitter) Emit(objType string, obj interface{}) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	switch v := obj.(type) {
+	case checker.Progress, *checker.Progress:
+	case *checker.BlockRange:
+		if v.Status == checker.BlockRangeStatusHole {
+			e.result.Holes = append(e.result.Holes, v)
+			e.result.HoleCount++
+			e.result.HoleBlockCount += holeBlockCount(v)
+		} else {
+			e.result.ValidRanges = append(e.result.ValidRanges, v)
+		}
+	case checker.Message:
+		e.result.Messages = append(e.result.Messages, v.Msg)
+	case *checker.Message:
+		e.result.Messages = append(e.result.Messages, v.Msg)
+	default:
+		payload, err := json.Marshal(obj)
+		if err != nil {
+			zlog.Warn("cannot marshal object", zap.String("object_type", objType), zap.Reflect("object", obj))
+			return
+		}
+
+		e.result.Events = append(e.result.Events, JobEvent{Type: objType, Payload: payload})
+		if isHole(obj) {
+			e.result.HoleCount++
+		}
+	}
+}
+
+// ndjsonEmitter writes every event as a line of JSON, in the same shape as
+// the websocket messages, flushing each one to the client.
+type ndjsonEmitter struct {
+	lock    sync.Mutex
+	w       http.ResponseWriter
+	encoder *json.Encoder
+}
+
+func (e *ndjsonEmitter) Emit(objType string, obj interface{}) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	err := e.encoder.Encode(map[string]interface{}{
+		"type":    objType,
+		"payload": obj,
+	})
+	if err != nil {
+		zlog.Info("cannot send check event", zap.String("object_type", objType), zap.Error(err))
+		return
+	}
+
+	if flusher, ok := e.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// serveCheckHTTP runs a check as a plain HTTP request. The `format` query
+// parameter, or else the `Accept` header, picks between a single JSON
+// document returned once the check completes (`json`, the default), a
+// chunked stream of newline delimited events (`ndjson`), and the `csv` and
+// repair `manifest` exports.
+func (d *Diagnose) serveCheckHTTP(w http.ResponseWriter, req *http.Request, c checker.Checker) {
+	format, err := checkResponseFormat(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := req.Context()
+	name := servedCheckName(req)
+
+	if format == "ndjson" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		emitter := &ndjsonEmitter{w: w, encoder: json.NewEncoder(w)}
+		if err := d.runServedCheck(ctx, req, c, emitter); err != nil {
+			zlog.Info("check failed", zap.Error(err))
+			emitter.Emit(WebsocketTypeMessage, &checker.Message{Msg: err.Error()})
+		}
+		zlog.Info("diagnose - check completed", zap.String("path", req.URL.Path))
+		return
+	}
+
+	if format == "csv" || format == "manifest" {
+		recorder := &eventRecorder{}
+		err := d.runServedCheck(ctx, req, c, recorder)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			zlog.Info("check failed", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		d.writeExport(w, format, name, "", func(name string) string { return getQueryParam(req, name) }, recorder.events)
+		zlog.Info("diagnose - check completed", zap.String("path", req.URL.Path))
+		return
+	}
+
+	result := newCheckResult(name)
+	startTime := time.Now()
+	err = d.runServedCheck(ctx, req, c, &checkResultEmitter{result: result})
+	result.Duration = time.Since(startTime).String()
+	if ctx.Err() != nil {
+		return
+	}
+
+	status := http.StatusOK
+	if err != nil {
+		zlog.Info("check failed", zap.Error(err))
+		result.Status = JobStatusFailed
+		result.Error = err.Error()
+		status = http.StatusInternalServerError
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(result)
+	zlog.Info("diagnose - check completed", zap.String("path", req.URL.Path))
+}
+
+func checkResponseFormat(req *http.Request) (string, error) {
+	switch format := getQueryParam(req, "format"); format {
+	case "json", "ndjson", "csv", "manifest":
+		return format, nil
+	case "":
+	default:
+		return "", fmt.Errorf("invalid format %q, expected 'json', 'ndjson', 'csv' or 'manifest'", format)
+	}
+
+	accept := req.Header.Get("Accept")
+	if strings.Contains(accept, "application/x-ndjson") || strings.Contains(accept, "application/ndjson") {
+		return "ndjson", nil
+	}
+	if strings.Contains(accept, "text/csv") {
+		return "csv", nil
+	}
+
+	return "json", nil
+}
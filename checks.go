@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/eoscanada/diagnose/checker"
+)
+
+// paramFunc returns the raw value of a named check parameter, or an empty
+// string when the parameter was not provided. Parameter names are the
+// `/api/*` query parameter names, e.g. `shard_size`.
+type paramFunc func(name string) string
+
+// checkFactory creates a ready to run check out of its parameters.
+type checkFactory func(param paramFunc) (checker.Checker, error)
+
+// checkFactories returns every check available for the configured
+// protocol, keyed by the name used by `diagnose check <name>`.
+func (d *Diagnose) checkFactories() map[string]checkFactory {
+	factories := map[string]checkFactory{
+		"block-holes":        d.newBlockHoles,
+		"search-holes":       d.newSearchHoles,
+		"search-coverage":    d.newSearchCoverage,
+		"search-tiers":       d.newSearchTiers,
+		"search-peer-shards": d.newSearchPeerShards,
+	}
+
+	switch d.Protocol {
+	case "EOS":
+		factories["kvdb-blk-holes"] = d.newEOSKVDBBlocks
+		factories["kvdb-blk-validation"] = d.newEOSKVDBBlocksValidation
+		factories["kvdb-trx-validation"] = d.newEOSKVDBTrxsValidation
+		factories["blocks-kvdb-consistency"] = d.newEOSBlocksConsistency
+		factories["kvdb-blk-irreversibility"] = d.newEOSKVDBIrreversibility
+		factories["kvdb-blk-forks"] = d.newEOSKVDBForks
+	case "ETH":
+		factories["kvdb-blk-holes"] = d.newETHKVDBBlocks
+		factories["kvdb-blk-validation"] = d.newETHKVDBBlocksValidation
+		factories["kvdb-trx-validation"] = d.newETHKVDBTrxsValidation
+		factories["blocks-kvdb-consistency"] = d.newETHBlocksConsistency
+		factories["kvdb-blk-irreversibility"] = d.newETHKVDBIrreversibility
+		factories["kvdb-blk-forks"] = d.newETHKVDBForks
+	}
+
+	return factories
+}
+
+// isHole returns whether an emitted object reports a problem: a hole
+// range, a fork or a transaction with a problem.
+func isHole(obj interface{}) bool {
+	switch v := obj.(type) {
+	case *checker.BlockRange:
+		return v.Status == checker.BlockRangeStatusHole
+	case *checker.Fork:
+		return v.Problem != ""
+	case *checker.Transaction:
+		return v.Problem != ""
+	}
+
+	return false
+}
+
+func (d *Diagnose) checkNames() (out []string) {
+	for name := range d.checkFactories() {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return
+}
+
+// blockBounds reads the optional, inclusive, `start_block` and `stop_block`
+// parameters. A zero `stopBlock` means the scan has no upper bound.
+func blockBounds(param paramFunc) (startBlock, stopBlock uint32, err error) {
+	parse := func(name string) (uint32, error) {
+		value := param(name)
+		if value == "" {
+			return 0, nil
+		}
+
+		num, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s %q: %s", name, value, err)
+		}
+
+		return uint32(num), nil
+	}
+
+	if startBlock, err = parse("start_block"); err != nil {
+		return
+	}
+	if stopBlock, err = parse("stop_block"); err != nil {
+		return
+	}
+
+	if stopBlock != 0 && stopBlock < startBlock {
+		err = fmt.Errorf("stop_block %d is lower than start_block %d", stopBlock, startBlock)
+	}
+	return
+}
+
+// concurrencyParam reads the optional `concurrency` parameter, the number
+// of sub-ranges scanned in parallel, defaulting to `checker.DefaultConcurrency`.
+func concurrencyParam(param paramFunc) (int, error) {
+	value := param("concurrency")
+	if value == "" {
+		return checker.DefaultConcurrency, nil
+	}
+
+	concurrency, err := strconv.ParseUint(value, 10, 16)
+	if err != nil || concurrency == 0 {
+		return 0, fmt.Errorf("invalid concurrency %q, expected a positive number", value)
+	}
+
+	return int(concurrency), nil
+}
+
+// boolParam reads an optional boolean parameter, false when absent.
+func boolParam(param paramFunc, name string) (bool, error) {
+	value := param(name)
+	if value == "" {
+		return false, nil
+	}
+
+	out, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: %s", name, value, err)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/eoscanada/diagnose/checker"
+)
+
+const (
+	checkExitOK    = 0
+	checkExitHoles = 1
+	checkExitError = 2
+)
+
+// runCheck implements `diagnose check <name> [flags]`. It runs a single
+// check without the HTTP server, prints its results to stdout and returns
+// the process exit code: 0 when no hole was found, 1 when at least one
+// `hole` range was reported and 2 when the check could not run.
+func runCheck(args []string) int {
+	d := newDiagnoseFromFlags()
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fmt.Fprintf(os.Stderr, "usage: diagnose check <name> [flags], available checks: %s\n", strings.Join(d.checkNames(), ", "))
+		return checkExitError
+	}
+
+	name := args[0]
+	flags := flag.NewFlagSet("check "+name, flag.ContinueOnError)
+	output := flags.String("output", "text", "Output format of the results, either 'text' or 'json' (newline delimited)")
+	flags.Uint("shard-size", 0, "Search shard size to check, defaults to -search-shard-size")
+	flags.String("shard-sizes", "", "Comma separated search shard sizes to compare, defaults to all configured shard sizes")
+	flags.Uint("start-block", 0, "First block of the range to check, inclusive")
+	flags.Uint("stop-block", 0, "Last block of the range to check, inclusive, 0 means up to the end of the store")
+	flags.String("layout", "merged", "Blocks store layout preset, 'merged' or 'one-block'")
+	flags.Uint("bundle-size", 0, "Number of blocks per file in the blocks store, overrides the layout preset")
+	flags.String("filename-pattern", "", "Regexp capturing the base block number of a blocks store filename, overrides the layout preset")
+	flags.Bool("deep", false, "Download and decode every merged blocks file or search shard instead of only checking file names")
+	flags.Bool("orphans", false, "Only report the transactions whose block is missing, not irreversible or has a different ID in the blocks table")
+	flags.Uint("head-block", 0, "Chain head block the search tiers are compared to, defaults to the highest search peer head")
+	flags.Uint("concurrency", checker.DefaultConcurrency, "Number of block sub-ranges scanned in parallel by KVDB block checks")
+	checkpointFile := flags.String("checkpoint-file", "", "File where the check saves its checkpoints, an interrupted check resumes from it when run again")
+
+	// Global flags are accepted after the check name too, they update the same
+	// values `d` was created from, so `d` is re-created after parsing.
+	flag.VisitAll(func(f *flag.Flag) {
+		flags.Var(f.Value, f.Name, f.Usage)
+	})
+
+	if err := flags.Parse(args[1:]); err != nil {
+		return checkExitError
+	}
+	d = newDiagnoseFromFlags()
+
+	factory, found := d.checkFactories()[name]
+	if !found {
+		fmt.Fprintf(os.Stderr, "unknown check %q for protocol %s, available checks: %s\n", name, d.Protocol, strings.Join(d.checkNames(), ", "))
+		return checkExitError
+	}
+
+	if *output != "text" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "invalid output format %q, expected 'text' or 'json'\n", *output)
+		return checkExitError
+	}
+
+	c, err := factory(flagSetParams(flags))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to create check %s: %s\n", name, err)
+		return checkExitError
+	}
+
+	if *checkpointFile != "" {
+		if err := useCheckpointFile(c, *checkpointFile); err != nil {
+			fmt.Fprintf(os.Stderr, "unable to use checkpoint file: %s\n", err)
+			return checkExitError
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	emitter := &cliEmitter{writer: os.Stdout, json: *output == "json"}
+	if err := c.Check(ctx, emitter); err != nil {
+		fmt.Fprintf(os.Stderr, "check %s failed: %s\n", name, err)
+		return checkExitError
+	}
+
+	if ctx.Err() != nil {
+		fmt.Fprintf(os.Stderr, "check %s interrupted\n", name)
+		return checkExitError
+	}
+
+	if *checkpointFile != "" {
+		os.Remove(*checkpointFile)
+	}
+
+	if emitter.holeCount > 0 {
+		return checkExitHoles
+	}
+
+	return checkExitOK
+}
+
+// useCheckpointFile makes a resumable check resume from the checkpoint
+// saved in `path`, when it exists, and save its checkpoints there.
+func useCheckpointFile(c checker.Checker, path string) error {
+	resumable, ok := c.(checker.Resumable)
+	if !ok {
+		return fmt.Errorf("check cannot be resumed")
+	}
+	checkpoints := resumable.Checkpoints()
+
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	default:
+		checkpoint := &checker.Checkpoint{}
+		if err := json.Unmarshal(data, checkpoint); err != nil {
+			return fmt.Errorf("invalid checkpoint file %s: %s", path, err)
+		}
+
+		fmt.Fprintf(os.Stderr, "resuming from block %d\n", checkpoint.NextBlock)
+		checkpoints.ResumeFrom = checkpoint
+	}
+
+	checkpoints.OnCheckpoint = func(checkpoint checker.Checkpoint) {
+		data, err := json.Marshal(checkpoint)
+		if err == nil {
+			err = ioutil.WriteFile(path+".tmp", data, 0644)
+		}
+		if err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to save checkpoint: %s\n", err)
+		}
+	}
+
+	return nil
+}
+
+// flagSetParams exposes the flags explicitly set on the command line as
+// check parameters, `shard_size` being read from `--shard-size`.
+func flagSetParams(flags *flag.FlagSet) paramFunc {
+	set := map[string]string{}
+	flags.Visit(func(f *flag.Flag) {
+		set[strings.Replace(f.Name, "-", "_", -1)] = f.Value.String()
+	})
+
+	return func(name string) string {
+		return set[name]
+	}
+}
+
+type cliEmitter struct {
+	writer    io.Writer
+	json      bool
+	holeCount int
+}
+
+func (e *cliEmitter) Emit(objType string, obj interface{}) {
+	if objType == checker.TypeProgress {
+		return
+	}
+
+	if isHole(obj) {
+		e.holeCount++
+	}
+
+	if e.json {
+		data, err := json.Marshal(map[string]interface{}{
+			"type":    objType,
+			"payload": obj,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot marshal %s: %s\n", objType, err)
+			return
+		}
+
+		fmt.Fprintln(e.writer, string(data))
+		return
+	}
+
+	switch v := obj.(type) {
+	case *checker.BlockRange:
+		fmt.Fprintf(e.writer, "%-5s %d-%d %s\n", v.Status, v.StarBlock, v.EndBlock, v.Message)
+	case *checker.Transaction:
+		fmt.Fprintf(e.writer, "trx   %s @ %d %s\n", v.Id, v.BlockNum, v.Problem)
+	case *checker.Fork:
+		var blocks []string
+		for _, block := range v.Blocks {
+			flags := ""
+			if block.Irreversible {
+				flags += " irreversible"
+			}
+			if block.Canonical {
+				flags += " canonical"
+			}
+			blocks = append(blocks, fmt.Sprintf("%s (%d trxs, %d orphans%s)", block.ID, block.TrxRefCount, block.OrphanTrxCount, flags))
+		}
+		fmt.Fprintf(e.writer, "fork  %d %s %s\n", v.BlockNum, strings.Join(blocks, ", "), v.Problem)
+	case *checker.Message:
+		fmt.Fprintf(e.writer, "msg   %s\n", v.Msg)
+	default:
+		fmt.Fprintf(e.writer, "%s %v\n", objType, obj)
+	}
+}
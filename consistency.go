@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/eoscanada/diagnose/checker"
+	"go.uber.org/zap"
+)
+
+func (d *Diagnose) EOSBlocksConsistency(w http.ResponseWriter, req *http.Request) {
+	d.serveCheck(w, req, d.newEOSBlocksConsistency)
+}
+
+func (d *Diagnose) newEOSBlocksConsistency(param paramFunc) (checker.Checker, error) {
+	kvdbInfo, db, err := d.getEOSDatabase(param)
+	if err != nil {
+		return nil, err
+	}
+
+	startBlock, stopBlock, err := blockBounds(param)
+	if err != nil {
+		return nil, err
+	}
+
+	blocksURL := d.blocksURL(param)
+	zlog.Info("diagnose - EOS  - blocks store and KVDB consistency", zap.String("block_store_url", blocksURL), zap.Reflect("connection_info", kvdbInfo))
+	return &checker.EOSBlocksConsistency{
+		BlocksStoreURL: blocksURL,
+		DB:             db,
+		StartBlock:     startBlock,
+		StopBlock:      stopBlock,
+	}, nil
+}
+
+func (d *Diagnose) ETHBlocksConsistency(w http.ResponseWriter, req *http.Request) {
+	d.serveCheck(w, req, d.newETHBlocksConsistency)
+}
+
+func (d *Diagnose) newETHBlocksConsistency(param paramFunc) (checker.Checker, error) {
+	kvdbInfo, db, err := d.getETHDatabase(param)
+	if err != nil {
+		return nil, err
+	}
+
+	startBlock, stopBlock, err := blockBounds(param)
+	if err != nil {
+		return nil, err
+	}
+
+	blocksURL := d.blocksURL(param)
+	zlog.Info("diagnose - ETH  - blocks store and KVDB consistency", zap.String("block_store_url", blocksURL), zap.Reflect("connection_info", kvdbInfo))
+	return &checker.ETHBlocksConsistency{
+		BlocksStoreURL: blocksURL,
+		DB:             db,
+		StartBlock:     startBlock,
+		StopBlock:      stopBlock,
+	}, nil
+}
@@ -5,10 +5,13 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.etcd.io/etcd/clientv3"
 	"go.uber.org/zap"
 	"k8s.io/client-go/kubernetes"
@@ -26,11 +29,16 @@ type Diagnose struct {
 	KvdbConnectionInfo    string   `json:"kvdbConnectionInfo,omitempty"`
 	DmeshServiceVersion   string   `json:"dmeshServiceVersion,omitempty"`
 
-	router        *mux.Router
-	upgrader      *websocket.Upgrader
-	cluster       *kubernetes.Clientset
-	dmeshStore    *clientv3.Client
-	serveFilePath string
+	router         *mux.Router
+	upgrader       *websocket.Upgrader
+	jobs           *jobManager
+	jobsStorePath  string
+	cluster        *kubernetes.Clientset
+	dmeshStore     *clientv3.Client
+	dmeshStoreAddr string
+	dmeshStoreLock sync.Mutex
+	peerHistory    *peerHistory
+	serveFilePath  string
 }
 
 func (d *Diagnose) SetupRoutes(dev bool) {
@@ -43,6 +51,11 @@ func (d *Diagnose) SetupRoutes(dev bool) {
 	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
 
 	d.upgrader = upgrader
+	d.jobs = newJobManager(newJobStore(d.jobsStorePath))
+	d.jobs.onComplete = func(job *Job, duration time.Duration) {
+		store := d.checkStore(job.Check, func(name string) string { return job.Params[name] })
+		recordCheckMetrics(job.Check, store, duration, job.HoleCount, job.HoleBlockCount)
+	}
 
 	router := mux.NewRouter()
 
@@ -51,17 +64,39 @@ func (d *Diagnose) SetupRoutes(dev bool) {
 	apiRouter.Path("/config").Methods("Get").HandlerFunc(d.config)
 	apiRouter.Path("/block_holes").Methods("GET").HandlerFunc(d.BlockHoles)
 	apiRouter.Path("/search_holes").Queries("shard_size", "{shard_size:[0-9]+}").Methods("GET").HandlerFunc(d.SearchHoles)
+	apiRouter.Path("/search_coverage").Methods("GET").HandlerFunc(d.SearchCoverage)
+	apiRouter.Path("/search_tiers").Methods("GET").HandlerFunc(d.SearchTiers)
+	apiRouter.Path("/search_peer_shards").Methods("GET").HandlerFunc(d.SearchPeerShards)
 	apiRouter.Path("/search_peers").Methods("Get").HandlerFunc(d.searchPeers)
+	apiRouter.Path("/search_peer_history").Methods("GET").HandlerFunc(d.searchPeerHistory)
+	apiRouter.Path("/dmesh_peers").Methods("GET").HandlerFunc(d.dmeshPeers)
+	apiRouter.Path("/dmesh_services").Methods("GET").HandlerFunc(d.dmeshServices)
+	apiRouter.Path("/jobs").Methods("POST").HandlerFunc(d.createJob)
+	apiRouter.Path("/jobs").Methods("GET").HandlerFunc(d.listJobs)
+	apiRouter.Path("/jobs/{id:[0-9a-z-]+}").Methods("GET").HandlerFunc(d.getJob)
+	apiRouter.Path("/jobs/{id:[0-9a-z-]+}/export").Methods("GET").HandlerFunc(d.exportJob)
+	apiRouter.Path("/jobs/{id:[0-9a-z-]+}/stream").Methods("GET").HandlerFunc(d.streamJob)
+	apiRouter.Path("/jobs/{id:[0-9a-z-]+}/cancel").Methods("POST").HandlerFunc(d.cancelJob)
+	apiRouter.Path("/jobs/{id:[0-9a-z-]+}/resume").Methods("POST").HandlerFunc(d.resumeJob)
 	switch d.Protocol {
 	case "EOS":
 		apiRouter.Path("/kvdb_blk_holes").Methods("GET").HandlerFunc(d.EOSKVDBBlocks)
 		apiRouter.Path("/kvdb_blk_validation").Methods("GET").HandlerFunc(d.EOSKVDBBlocksValidation)
 		apiRouter.Path("/kvdb_trx_validation").Methods("GET").HandlerFunc(d.EOSKVDBTrxsValidation)
+		apiRouter.Path("/blocks_kvdb_consistency").Methods("GET").HandlerFunc(d.EOSBlocksConsistency)
+		apiRouter.Path("/kvdb_blk_irreversibility").Methods("GET").HandlerFunc(d.EOSKVDBIrreversibility)
+		apiRouter.Path("/kvdb_blk_forks").Methods("GET").HandlerFunc(d.EOSKVDBForks)
 	case "ETH":
 		apiRouter.Path("/kvdb_blk_holes").Methods("GET").HandlerFunc(d.ETHKVDBBlocks)
 		apiRouter.Path("/kvdb_blk_validation").Methods("GET").HandlerFunc(d.ETHKVDBBlockValidation)
+		apiRouter.Path("/kvdb_trx_validation").Methods("GET").HandlerFunc(d.ETHKVDBTrxsValidation)
+		apiRouter.Path("/blocks_kvdb_consistency").Methods("GET").HandlerFunc(d.ETHBlocksConsistency)
+		apiRouter.Path("/kvdb_blk_irreversibility").Methods("GET").HandlerFunc(d.ETHKVDBIrreversibility)
+		apiRouter.Path("/kvdb_blk_forks").Methods("GET").HandlerFunc(d.ETHKVDBForks)
 	}
 
+	router.Path("/metrics").Methods("GET").Handler(promhttp.Handler())
+
 	// SPA + static contents handling
 	coreRouter := router.PathPrefix("/").Subrouter()
 	coreRouter.PathPrefix("/").Handler(NewSPAHandler(d.serveFilePath, dev))
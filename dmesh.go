@@ -2,39 +2,358 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
+	"strings"
 
+	"github.com/eoscanada/diagnose/checker"
 	"github.com/eoscanada/dmesh"
+	"github.com/gorilla/websocket"
+	"go.etcd.io/etcd/clientv3"
 	"go.uber.org/zap"
 )
 
-func (r *Diagnose) searchPeers(w http.ResponseWriter, req *http.Request) {
-	zlog.Info("diagnose - Search Peers")
+// Peer event names, as sent by dmesh: `sync` for the peers present when
+// the observation starts, then `update` and `delete`.
+const (
+	PeerEventSync   = "sync"
+	PeerEventUpdate = "update"
+	PeerEventDelete = "delete"
+)
 
-	ctx, cancel := context.WithCancel(req.Context())
+// dmeshPeerTypes creates the peer type of each known dmesh service, for
+// the peers read outside of `dmesh.Observe`. Peers of other services are
+// decoded as generic JSON objects.
+var dmeshPeerTypes = map[string]func() interface{}{
+	"search": func() interface{} { return &dmesh.SearchPeer{} },
+}
+
+// DmeshPeer is a peer of a `DmeshPeerSnapshot`, `Peer` being decoded into
+// the service's peer type.
+type DmeshPeer struct {
+	Key  string      `json:"key"`
+	Peer interface{} `json:"peer"`
+}
+
+// DmeshPeerSnapshot is the set of peers of a service at a single etcd
+// revision. `Tiers` summarizes the search peers, per tier.
+type DmeshPeerSnapshot struct {
+	Version   string               `json:"version"`
+	Service   string               `json:"service"`
+	Revision  int64                `json:"revision"`
+	HeadBlock uint64               `json:"headBlockNum,omitempty"`
+	Peers     []*DmeshPeer         `json:"peers"`
+	Tiers     []*SearchTierSummary `json:"tiers,omitempty"`
+}
+
+// SearchTierSummary sums up the search peers of a tier, the block range
+// being the one served by its ready peers.
+type SearchTierSummary struct {
+	Tier           uint32   `json:"tier"`
+	PeerCount      int      `json:"peerCount"`
+	ReadyPeerCount int      `json:"readyPeerCount"`
+	TailBlock      uint64   `json:"tailBlockNum"`
+	IrrBlock       uint64   `json:"irrBlockNum"`
+	HeadBlock      uint64   `json:"headBlockNum"`
+	ShardSizes     []uint64 `json:"shardSizes"`
+	Hosts          []string `json:"hosts"`
+}
+
+// DmeshService is a service prefix found under the namespace.
+type DmeshService struct {
+	Prefix    string `json:"prefix"`
+	Version   string `json:"version"`
+	Service   string `json:"service"`
+	PeerCount int    `json:"peerCount"`
+}
+
+// searchPeers is kept for the existing UI, it observes the `search`
+// service.
+func (d *Diagnose) searchPeers(w http.ResponseWriter, req *http.Request) {
+	d.servePeers(w, req, "search")
+}
+
+// dmeshPeers implements `/api/dmesh_peers?service=<name>`, streaming the
+// peer events of any dmesh service on a websocket. The `version`
+// parameter defaults to `--mesh-service-version`. Requests that are not
+// websocket upgrades get a snapshot of the peers, see `servePeerSnapshot`.
+func (d *Diagnose) dmeshPeers(w http.ResponseWriter, req *http.Request) {
+	service := getQueryParam(req, "service")
+	if service == "" {
+		http.Error(w, "missing service parameter", http.StatusBadRequest)
+		return
+	}
+
+	d.servePeers(w, req, service)
+}
+
+func (d *Diagnose) servePeers(w http.ResponseWriter, req *http.Request, service string) {
+	version := getQueryParam(req, "version")
+	if version == "" {
+		version = d.DmeshServiceVersion
+	}
+
+	if !websocket.IsWebSocketUpgrade(req) {
+		d.servePeerSnapshot(w, req, version, service)
+		return
+	}
 
-	conn, err := r.upgrader.Upgrade(w, req, nil)
+	conn, err := d.upgrader.Upgrade(w, req, nil)
 	if err != nil {
 		return
 	}
 	defer conn.Close()
 
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
 	go readWebsocket(conn, cancel)
 
-	servicePrefix := fmt.Sprintf("%s/search", r.DmeshServiceVersion)
+	zlog.Info("diagnose - dmesh peers", zap.String("namespace", d.Namespace), zap.String("version", version), zap.String("service", service))
+	err = d.observePeers(ctx, version, service, func(event *dmesh.PeerEvent) {
+		maybeSendWebsocket(conn, WebsocketTypePeerEvent, event)
+	})
+	if err != nil && ctx.Err() == nil {
+		zlog.Info("observing dmesh failed", zap.Error(err))
+		maybeSendWebsocket(conn, WebsocketTypeMessage, &checker.Message{Msg: err.Error()})
+	}
+	zlog.Info("diagnose - dmesh peers - completed")
+}
+
+// servePeerSnapshot returns the peers of the service as a single JSON
+// `DmeshPeerSnapshot`, read at a single etcd revision so deleted peers are
+// already gone.
+func (d *Diagnose) servePeerSnapshot(w http.ResponseWriter, req *http.Request, version, service string) {
+	snapshot, err := d.peerSnapshot(req.Context(), version, service)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to read dmesh peers: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(snapshot)
+}
+
+// peerSnapshot reads every peer of the service, summarizing search peers
+// per tier.
+func (d *Diagnose) peerSnapshot(ctx context.Context, version, service string) (*DmeshPeerSnapshot, error) {
+	store, err := d.meshStore()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := store.Get(ctx, fmt.Sprintf("%s%s/%s/", d.dmeshNamespaceKey(), version, service), clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &DmeshPeerSnapshot{
+		Version:  version,
+		Service:  service,
+		Revision: resp.Header.Revision,
+		Peers:    []*DmeshPeer{},
+	}
+
+	tiers := map[uint32]*SearchTierSummary{}
+	for _, kv := range resp.Kvs {
+		snapshotPeer := &DmeshPeer{Key: string(kv.Key), Peer: decodePeer(service, kv.Key, kv.Value)}
+		snapshot.Peers = append(snapshot.Peers, snapshotPeer)
+
+		peer, ok := snapshotPeer.Peer.(*dmesh.SearchPeer)
+		if !ok {
+			continue
+		}
+
+		if peer.HeadBlock > snapshot.HeadBlock {
+			snapshot.HeadBlock = peer.HeadBlock
+		}
+
+		tier := tiers[peer.TierLevel]
+		if tier == nil {
+			tier = &SearchTierSummary{Tier: peer.TierLevel, ShardSizes: []uint64{}, Hosts: []string{}}
+			tiers[peer.TierLevel] = tier
+			snapshot.Tiers = append(snapshot.Tiers, tier)
+		}
+		tier.addPeer(peer)
+	}
+
+	sort.Slice(snapshot.Tiers, func(i, j int) bool {
+		return snapshot.Tiers[i].Tier < snapshot.Tiers[j].Tier
+	})
+	return snapshot, nil
+}
+
+func (s *SearchTierSummary) addPeer(peer *dmesh.SearchPeer) {
+	s.PeerCount++
+	s.Hosts = append(s.Hosts, peer.Host)
+
+	found := false
+	for _, shardSize := range s.ShardSizes {
+		found = found || shardSize == peer.ShardSize
+	}
+	if !found {
+		s.ShardSizes = append(s.ShardSizes, peer.ShardSize)
+	}
 
-	zlog.Info("observing dmesh", zap.String("namespace", r.Namespace), zap.String("service_prefix", servicePrefix))
-	eventChan := dmesh.Observe(ctx, r.dmeshStore, r.Namespace, servicePrefix)
+	if !peer.Ready {
+		return
+	}
+
+	if s.ReadyPeerCount == 0 || peer.TailBlock < s.TailBlock {
+		s.TailBlock = peer.TailBlock
+	}
+	if peer.IrrBlock > s.IrrBlock {
+		s.IrrBlock = peer.IrrBlock
+	}
+	if peer.HeadBlock > s.HeadBlock {
+		s.HeadBlock = peer.HeadBlock
+	}
+	s.ReadyPeerCount++
+}
+
+// dmeshServices implements `GET /api/dmesh_services`, listing the service
+// prefixes currently holding peers under the namespace. dmesh has no
+// listing of its own, the peer keys are read instead.
+func (d *Diagnose) dmeshServices(w http.ResponseWriter, req *http.Request) {
+	store, err := d.meshStore()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := store.Get(req.Context(), d.dmeshNamespaceKey(), clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to list dmesh keys: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	byPrefix := map[string]*DmeshService{}
+	for _, kv := range resp.Kvs {
+		version, service, ok := d.parseDmeshKey(string(kv.Key))
+		if !ok {
+			continue
+		}
+
+		prefix := version + "/" + service
+		if byPrefix[prefix] == nil {
+			byPrefix[prefix] = &DmeshService{Prefix: prefix, Version: version, Service: service}
+		}
+		byPrefix[prefix].PeerCount++
+	}
+
+	services := []*DmeshService{}
+	for _, service := range byPrefix {
+		services = append(services, service)
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Prefix < services[j].Prefix
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(services)
+}
+
+// dmeshNamespaceKey is the etcd prefix of every dmesh key of the
+// namespace, peers being stored under
+// `/<namespace>/<version>/<service>/<peer>`.
+func (d *Diagnose) dmeshNamespaceKey() string {
+	return fmt.Sprintf("/%s/", d.Namespace)
+}
+
+// parseDmeshKey returns the version and service of a peer key.
+func (d *Diagnose) parseDmeshKey(key string) (version, service string, ok bool) {
+	parts := strings.SplitN(strings.TrimPrefix(key, d.dmeshNamespaceKey()), "/", 3)
+	if len(parts) < 3 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
+
+// observePeers calls `f` with every event of `dmesh.Observe` for the
+// service, a `sync` event for every peer present then an event for every
+// change, until `ctx` is done.
+func (d *Diagnose) observePeers(ctx context.Context, version, service string, f func(event *dmesh.PeerEvent)) error {
+	store, err := d.meshStore()
+	if err != nil {
+		return err
+	}
+
+	events := dmesh.Observe(ctx, store, d.Namespace, fmt.Sprintf("%s/%s", version, service))
 	for {
 		select {
 		case <-ctx.Done():
-			zlog.Debug("context canceled")
-			return
-		case peer := <-eventChan:
-			maybeSendWebsocket(conn, WebsocketTypePeerEvent, peer)
+			return ctx.Err()
+		case event, ok := <-events:
+			if !ok {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return fmt.Errorf("dmesh observation of %s/%s ended", version, service)
+			}
+			f(event)
+		}
+	}
+}
+
+// searchTierPeers returns a snapshot of the search peers.
+func (d *Diagnose) searchTierPeers(ctx context.Context, version string) ([]*checker.SearchTierPeer, error) {
+	snapshot, err := d.peerSnapshot(ctx, version, "search")
+	if err != nil {
+		return nil, err
+	}
+
+	var peers []*checker.SearchTierPeer
+	for _, snapshotPeer := range snapshot.Peers {
+		peer, ok := snapshotPeer.Peer.(*dmesh.SearchPeer)
+		if !ok {
+			continue
 		}
+
+		peers = append(peers, &checker.SearchTierPeer{
+			Host:       peer.Host,
+			Tier:       peer.TierLevel,
+			Ready:      peer.Ready,
+			TailBlock:  uint32(peer.TailBlock),
+			IrrBlock:   uint32(peer.IrrBlock),
+			HeadBlock:  uint32(peer.HeadBlock),
+			MovingHead: peer.HasMovingHead,
+			ShardSize:  uint32(peer.ShardSize),
+		})
+	}
+
+	return peers, nil
+}
+
+// meshStore returns the dmesh store, connecting to `--mesh-store-addr` on
+// first use when the store was not set up, as for `diagnose check`.
+func (d *Diagnose) meshStore() (*clientv3.Client, error) {
+	d.dmeshStoreLock.Lock()
+	defer d.dmeshStoreLock.Unlock()
+
+	if d.dmeshStore == nil {
+		store, err := dmesh.NewStore(d.dmeshStoreAddr)
+		if err != nil {
+			return nil, fmt.Errorf("unable to setup dmesh store (etcd): %s", err)
+		}
+		d.dmeshStore = store
+	}
+
+	return d.dmeshStore, nil
+}
+
+// decodePeer decodes a peer into the service's peer type.
+func decodePeer(service string, key, value []byte) interface{} {
+	var peer interface{} = &map[string]interface{}{}
+	if newPeer, found := dmeshPeerTypes[service]; found {
+		peer = newPeer()
+	}
+
+	if err := json.Unmarshal(value, peer); err != nil {
+		zlog.Info("unable to decode dmesh peer", zap.String("key", string(key)), zap.Error(err))
 	}
-	zlog.Info("diagnose - Search Peers - Complete")
 
+	return peer
 }
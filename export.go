@@ -0,0 +1,424 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eoscanada/diagnose/checker"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// Repair targets are the tools rebuilding a missing range.
+const (
+	RepairTargetMerger     = "merger"
+	RepairTargetIndexer    = "indexer"
+	RepairTargetKVDBLoader = "kvdb-loader"
+)
+
+// exportRow is a block range, fork or transaction reported by a check, as
+// exported to CSV.
+type exportRow struct {
+	Type       string
+	StartBlock uint32
+	EndBlock   uint32
+	Status     string
+	ID         string
+	Message    string
+	Store      string
+}
+
+var exportHeader = []string{"type", "start_block", "end_block", "status", "id", "message"}
+
+// exportRows returns the rows of the block range, fork and transaction
+// events, in emission order. Forks and transactions with a problem have
+// the `hole` status.
+func exportRows(events []JobEvent) (rows []exportRow) {
+	problemStatus := func(problem string) string {
+		if problem != "" {
+			return checker.BlockRangeStatusHole
+		}
+		return checker.BlockRangeStatusValid
+	}
+
+	for _, event := range events {
+		switch event.Type {
+		case WebsocketTypeBlockRange:
+			var blockRange checker.BlockRange
+			if json.Unmarshal(event.Payload, &blockRange) == nil {
+				rows = append(rows, exportRow{
+					Type:       event.Type,
+					StartBlock: blockRange.StarBlock,
+					EndBlock:   blockRange.EndBlock,
+					Status:     blockRange.Status,
+					Message:    blockRange.Message,
+					Store:      blockRange.Store,
+				})
+			}
+
+		case WebsocketTypeFork:
+			var fork checker.Fork
+			if json.Unmarshal(event.Payload, &fork) == nil {
+				message := fork.Problem
+				if message == "" {
+					message = fmt.Sprintf("%d blocks at height", len(fork.Blocks))
+				}
+				rows = append(rows, exportRow{
+					Type:       event.Type,
+					StartBlock: fork.BlockNum,
+					EndBlock:   fork.BlockNum,
+					Status:     problemStatus(fork.Problem),
+					Message:    message,
+				})
+			}
+
+		case WebsocketTypeTransaction:
+			var trx checker.Transaction
+			if json.Unmarshal(event.Payload, &trx) == nil {
+				rows = append(rows, exportRow{
+					Type:       event.Type,
+					StartBlock: trx.BlockNum,
+					EndBlock:   trx.BlockNum,
+					Status:     problemStatus(trx.Problem),
+					ID:         trx.Id,
+					Message:    trx.Problem,
+				})
+			}
+		}
+	}
+
+	return rows
+}
+
+func writeCSV(w io.Writer, rows []exportRow) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(exportHeader); err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		err := writer.Write([]string{
+			row.Type,
+			strconv.FormatUint(uint64(row.StartBlock), 10),
+			strconv.FormatUint(uint64(row.EndBlock), 10),
+			row.Status,
+			row.ID,
+			row.Message,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// RepairManifest lists the block ranges to rebuild after a check, aligned
+// on the bundle size of the store to repair, each range along with the
+// tool rebuilding it and the problems found in it.
+type RepairManifest struct {
+	Check      string        `json:"check"`
+	Store      string        `json:"store"`
+	BundleSize uint32        `json:"bundleSize"`
+	JobID      string        `json:"jobId,omitempty"`
+	CreatedAt  time.Time     `json:"createdAt"`
+	Ranges     []RepairRange `json:"ranges"`
+}
+
+type RepairRange struct {
+	StartBlock uint32   `json:"startBlock"`
+	EndBlock   uint32   `json:"endBlock"`
+	Target     string   `json:"target"`
+	Reasons    []string `json:"reasons"`
+}
+
+// newRepairManifest aligns the hole rows on `bundleSize` and merges the
+// overlapping or contiguous ranges having the same target.
+func newRepairManifest(check, store string, bundleSize uint32, rows []exportRow) *RepairManifest {
+	if bundleSize == 0 {
+		bundleSize = 1
+	}
+
+	var ranges []RepairRange
+	for _, row := range rows {
+		if row.Status != checker.BlockRangeStatusHole {
+			continue
+		}
+
+		target := repairTarget(check, row.Store)
+		if target == "" {
+			continue
+		}
+
+		end := uint64(row.EndBlock)/uint64(bundleSize)*uint64(bundleSize) + uint64(bundleSize) - 1
+		if end > uint64(^uint32(0)) {
+			end = uint64(^uint32(0))
+		}
+
+		ranges = append(ranges, RepairRange{
+			StartBlock: row.StartBlock / bundleSize * bundleSize,
+			EndBlock:   uint32(end),
+			Target:     target,
+			Reasons:    []string{row.Message},
+		})
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool {
+		if ranges[i].Target != ranges[j].Target {
+			return ranges[i].Target < ranges[j].Target
+		}
+		return ranges[i].StartBlock < ranges[j].StartBlock
+	})
+
+	manifest := &RepairManifest{
+		Check:      check,
+		Store:      store,
+		BundleSize: bundleSize,
+		CreatedAt:  time.Now().UTC(),
+		Ranges:     []RepairRange{},
+	}
+
+	for _, rng := range ranges {
+		last := len(manifest.Ranges) - 1
+		if last >= 0 {
+			previous := &manifest.Ranges[last]
+			if previous.Target == rng.Target && uint64(rng.StartBlock) <= uint64(previous.EndBlock)+1 {
+				if rng.EndBlock > previous.EndBlock {
+					previous.EndBlock = rng.EndBlock
+				}
+				previous.Reasons = appendReason(previous.Reasons, rng.Reasons[0])
+				continue
+			}
+		}
+		manifest.Ranges = append(manifest.Ranges, rng)
+	}
+
+	sort.SliceStable(manifest.Ranges, func(i, j int) bool {
+		return manifest.Ranges[i].StartBlock < manifest.Ranges[j].StartBlock
+	})
+
+	return manifest
+}
+
+// maxRepairReasons caps the reasons kept per range, merged ranges may
+// group thousands of holes.
+const maxRepairReasons = 10
+
+func appendReason(reasons []string, reason string) []string {
+	if len(reasons) >= maxRepairReasons {
+		return reasons
+	}
+	for _, existing := range reasons {
+		if existing == reason {
+			return reasons
+		}
+	}
+	return append(reasons, reason)
+}
+
+// repairTarget returns the tool rebuilding a hole of the named check, ""
+// when no rebuild fixes it. The blocks store and KVDB consistency check
+// reports holes of both stores, each hole naming the `store` to rebuild.
+func repairTarget(check, store string) string {
+	switch check {
+	case "block-holes":
+		return RepairTargetMerger
+	case "search-holes", "search-coverage":
+		return RepairTargetIndexer
+	case "search-peer-shards":
+		// Only the shards missing from the archive name their store, the
+		// archived shards no peer serves are a peer availability problem.
+		if store != "" {
+			return RepairTargetIndexer
+		}
+		return ""
+	case "search-tiers":
+		// Tiers only report on peer availability.
+		return ""
+	case "blocks-kvdb-consistency":
+		if store == checker.StoreMergedBlocks {
+			return RepairTargetMerger
+		}
+	}
+
+	return RepairTargetKVDBLoader
+}
+
+// repairBundleSize returns the number of blocks rebuilt at once in the
+// store repaired for the named check, out of its parameters, or out of
+// the shards stores named by the hole `rows`.
+func (d *Diagnose) repairBundleSize(name string, param paramFunc, rows []exportRow) uint32 {
+	switch name {
+	case "block-holes":
+		if layout, err := blockFilesLayout(param); err == nil {
+			return layout.BundleSize
+		}
+		return checker.MergedBlocksLayout.BundleSize
+	case "search-holes":
+		return d.shardSize(param)
+	case "search-coverage", "search-tiers":
+		// Holes aligned on the largest shard size are aligned on the
+		// smaller ones too.
+		shardSizes, err := d.shardSizes(param)
+		if err != nil {
+			return 1
+		}
+		return largestShardSize(shardSizes)
+	case "search-peer-shards":
+		// Shard sizes are the ones advertised by the peers, as named by the
+		// stores of the holes.
+		var shardSizes []uint32
+		for _, row := range rows {
+			if !strings.HasPrefix(row.Store, checker.StoreShardsPrefix) {
+				continue
+			}
+			if shardSize, err := strconv.ParseUint(strings.TrimPrefix(row.Store, checker.StoreShardsPrefix), 10, 32); err == nil {
+				shardSizes = append(shardSizes, uint32(shardSize))
+			}
+		}
+		return largestShardSize(shardSizes)
+	case "blocks-kvdb-consistency":
+		return checker.MergedBlocksLayout.BundleSize
+	}
+
+	return 1
+}
+
+func largestShardSize(shardSizes []uint32) uint32 {
+	largest := uint32(1)
+	for _, shardSize := range shardSizes {
+		if shardSize > largest {
+			largest = shardSize
+		}
+	}
+	return largest
+}
+
+// writeExport writes the events of a check run in the `csv` or `manifest`
+// format, as a file download.
+func (d *Diagnose) writeExport(w http.ResponseWriter, format, name, jobID string, param paramFunc, events []JobEvent) {
+	filename := name
+	if jobID != "" {
+		filename = jobID
+	}
+
+	rows := exportRows(events)
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".csv"))
+		if err := writeCSV(w, rows); err != nil {
+			zlog.Info("cannot write csv export", zap.Error(err))
+		}
+
+	case "manifest":
+		manifest := newRepairManifest(name, d.checkStore(name, param), d.repairBundleSize(name, param, rows), rows)
+		manifest.JobID = jobID
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+"-repair.json"))
+		_ = json.NewEncoder(w).Encode(manifest)
+	}
+}
+
+// eventRecorder keeps every event but progress, as a job does.
+type eventRecorder struct {
+	lock   sync.Mutex
+	events []JobEvent
+}
+
+func (r *eventRecorder) Emit(objType string, obj interface{}) {
+	switch obj.(type) {
+	case checker.Progress, *checker.Progress:
+		return
+	}
+
+	payload, err := json.Marshal(obj)
+	if err != nil {
+		zlog.Warn("cannot marshal object", zap.String("object_type", objType), zap.Reflect("object", obj))
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.events = append(r.events, JobEvent{Type: objType, Payload: payload})
+}
+
+// exportJob implements `GET /api/jobs/{id}/export`, the `format` query
+// parameter being `json` (the default), `csv` or `manifest`.
+func (d *Diagnose) exportJob(w http.ResponseWriter, req *http.Request) {
+	format := getQueryParam(req, "format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" && format != "manifest" {
+		http.Error(w, fmt.Sprintf("invalid format %q, expected 'json', 'csv' or 'manifest'", format), http.StatusBadRequest)
+		return
+	}
+
+	job, events, found, err := d.jobs.get(mux.Vars(req)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+
+	if format != "json" {
+		d.writeExport(w, format, job.Check, job.ID, func(name string) string { return job.Params[name] }, events)
+		return
+	}
+
+	result := newJobCheckResult(job, events)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", job.ID+".json"))
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// newJobCheckResult returns a job's events in the same document as a check
+// served as plain HTTP.
+func newJobCheckResult(job *Job, events []JobEvent) *checkResult {
+	result := newCheckResult(job.Check)
+	result.Status = job.Status
+	result.Error = job.Error
+	if job.FinishedAt != nil {
+		result.Duration = job.FinishedAt.Sub(job.CreatedAt).String()
+	}
+
+	for _, event := range events {
+		switch event.Type {
+		case WebsocketTypeBlockRange:
+			blockRange := &checker.BlockRange{}
+			if json.Unmarshal(event.Payload, blockRange) != nil {
+				continue
+			}
+			if blockRange.Status == checker.BlockRangeStatusHole {
+				result.Holes = append(result.Holes, blockRange)
+			} else {
+				result.ValidRanges = append(result.ValidRanges, blockRange)
+			}
+		case WebsocketTypeMessage:
+			var message checker.Message
+			if json.Unmarshal(event.Payload, &message) == nil {
+				result.Messages = append(result.Messages, message.Msg)
+			}
+		default:
+			result.Events = append(result.Events, event)
+		}
+	}
+
+	result.HoleCount = job.HoleCount
+	result.HoleBlockCount = job.HoleBlockCount
+	return result
+}
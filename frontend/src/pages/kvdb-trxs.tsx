@@ -72,7 +72,7 @@ export const KvdbTrxsPage: React.FC = () => {
               twoToneColor="#f5222d"
             />
             Transaction <a href={`https://eosq.app/${item.payload.id}`}>{item.payload.prefix}</a> @
-            #{item.payload.blockNum} missing meta:written column
+            #{item.payload.blockNum} {item.payload.problem || "missing meta:written column"}
           </List.Item>
         )
       case "Message":
@@ -26,6 +26,7 @@ export interface TransactionSocketMessage {
     prefix: string
     id: string
     blockNum: number
+    problem?: string
   }
 }
 
@@ -37,6 +38,34 @@ export interface BlockRangeSocketMessage {
     endBlock: number
     message: string
     status: "valid" | "hole"
+    // "merged-blocks", "kvdb" or a search shards store like "shards-5000"
+    store?: string
+  }
+}
+
+export type MissingColumns = MissingColumnsSocketMessage["payload"]
+export interface MissingColumnsSocketMessage {
+  type: "MissingColumns"
+  payload: {
+    startBlock: number
+    endBlock: number
+    columns: string[]
+  }
+}
+
+export type Fork = ForkSocketMessage["payload"]
+export interface ForkSocketMessage {
+  type: "Fork"
+  payload: {
+    blockNum: number
+    blocks: {
+      id: string
+      irreversible: boolean
+      canonical: boolean
+      trxRefCount: number
+      orphanTrxCount: number
+    }[]
+    problem?: string
   }
 }
 
@@ -80,6 +109,8 @@ export interface Peer {
 export type SocketMessage =
   | TransactionSocketMessage
   | BlockRangeSocketMessage
+  | MissingColumnsSocketMessage
+  | ForkSocketMessage
   | MessageSocketMessage
   | PeerEventSocketMessage
   | ProgressSocketMessage
@@ -2,6 +2,12 @@ module github.com/eoscanada/diagnose
 
 require (
 	cloud.google.com/go v0.43.0
+	github.com/RoaringBitmap/roaring v0.4.21 // indirect
+	github.com/blevesearch/bleve v0.8.0
+	github.com/blevesearch/go-porterstemmer v1.0.2 // indirect
+	github.com/blevesearch/segment v0.8.0 // indirect
+	github.com/couchbase/vellum v0.0.0-20190626091642-41f2deade2cf // indirect
+	github.com/edsrzf/mmap-go v1.0.0 // indirect
 	github.com/eoscanada/bstream v1.6.3-0.20191128232437-4b607131f34e
 	github.com/eoscanada/derr v0.3.9
 	github.com/eoscanada/dgrpc v0.0.0-20191115165705-af05d03bcdcb
@@ -12,15 +18,22 @@ require (
 	github.com/eoscanada/logging v0.6.6
 	github.com/eoscanada/search v0.0.0-20191129050617-aa1cdc9828f2
 	github.com/eoscanada/validator v0.4.1-0.20190807042112-8fbbe313c8e8
+	github.com/etcd-io/bbolt v1.3.3 // indirect
+	github.com/golang/protobuf v1.3.2
+	github.com/golang/snappy v0.0.1 // indirect
 	github.com/googleapis/gnostic v0.2.0 // indirect
 	github.com/gorilla/handlers v0.0.0-20181012153334-350d97a79266
 	github.com/gorilla/mux v1.7.0
 	github.com/gorilla/websocket v1.4.1
 	github.com/gregjones/httpcache v0.0.0-20190203031600-7a902570cb17 // indirect
+	github.com/klauspost/compress v1.8.5
 	github.com/koding/websocketproxy v0.0.0-20181220232114-7ed82d81a28c
 	github.com/peterbourgon/diskv v2.0.1+incompatible // indirect
+	github.com/prometheus/client_golang v1.2.1
 	github.com/spf13/pflag v1.0.5 // indirect
+	github.com/steveyen/gtreap v0.0.0-20150807155958-0abe01ef9be2 // indirect
 	github.com/thedevsaddam/govalidator v1.9.6
+	github.com/willf/bitset v1.1.10 // indirect
 	go.etcd.io/etcd v0.0.0-20191023171146-3cf2f69b5738
 	go.uber.org/zap v1.12.0
 	k8s.io/api v0.0.0-20190222213804-5cb15d344471 // indirect
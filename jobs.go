@@ -0,0 +1,744 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/eoscanada/diagnose/checker"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	JobStatusRunning   = "running"
+	JobStatusCompleted = "completed"
+	JobStatusFailed    = "failed"
+	JobStatusCanceled  = "canceled"
+
+	// JobStatusInterrupted is a job that was running when the server
+	// stopped and that cannot be resumed automatically.
+	JobStatusInterrupted = "interrupted"
+)
+
+// checkpointSaveInterval throttles how often the checkpoint of a running
+// job is persisted, checks may report one every few seconds.
+const checkpointSaveInterval = 30 * time.Second
+
+// maxJobEventsInMemory is the number of most recent events of a running
+// job kept in memory, the older ones being read back from its events file.
+const maxJobEventsInMemory = 10000
+
+// Job is a check run server side, independently of any websocket.
+type Job struct {
+	ID             string            `json:"id"`
+	Check          string            `json:"check"`
+	Params         map[string]string `json:"params,omitempty"`
+	Schedule       string            `json:"schedule,omitempty"`
+	Status         string            `json:"status"`
+	Error          string            `json:"error,omitempty"`
+	CreatedAt      time.Time         `json:"createdAt"`
+	FinishedAt     *time.Time        `json:"finishedAt,omitempty"`
+	Progress       *checker.Progress `json:"progress,omitempty"`
+	EventCount     int               `json:"eventCount"`
+	HoleCount      int               `json:"holeCount"`
+	HoleBlockCount uint64            `json:"holeBlockCount"`
+	ResumedAt      *time.Time        `json:"resumedAt,omitempty"`
+}
+
+// JobEvent is an event emitted by a job's check, in the same shape as the
+// websocket messages.
+type JobEvent struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// jobCheckpoint is the last checkpoint of a resumable check, along with
+// the job's counts at that moment: the events emitted after it are
+// emitted again by a resumed run.
+type jobCheckpoint struct {
+	EventCount     int                `json:"eventCount"`
+	HoleCount      int                `json:"holeCount"`
+	HoleBlockCount uint64             `json:"holeBlockCount"`
+	Checkpoint     checker.Checkpoint `json:"checkpoint"`
+}
+
+// runningJob records the events of a running check. Progress events only
+// update the job's progress, every other event is appended to the job's
+// events file for replay, the most recent ones being also kept in memory:
+// `events` starts at the job's event `firstEvent`.
+type runningJob struct {
+	lock       sync.Mutex
+	job        Job
+	store      *jobStore
+	eventsFile *jobEventsFile
+	events     []JobEvent
+	firstEvent int
+	checkpoint *jobCheckpoint
+	changed    chan struct{}
+	cancel     context.CancelFunc
+}
+
+func (r *runningJob) Emit(objType string, obj interface{}) {
+	payload, err := json.Marshal(obj)
+	if err != nil {
+		zlog.Warn("cannot marshal object", zap.String("object_type", objType), zap.Reflect("object", obj))
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	switch v := obj.(type) {
+	case checker.Progress:
+		r.job.Progress = &v
+	case *checker.Progress:
+		r.job.Progress = v
+	default:
+		event := JobEvent{Type: objType, Payload: payload}
+		if err := r.eventsFile.append(event); err != nil {
+			zlog.Warn("cannot write job event", zap.String("job_id", r.job.ID), zap.Error(err))
+		}
+
+		// Events are dropped from memory in batches, rather than one by
+		// one, not to copy the whole tail on every event.
+		r.events = append(r.events, event)
+		if len(r.events) >= 2*maxJobEventsInMemory {
+			dropped := len(r.events) - maxJobEventsInMemory
+			r.events = append([]JobEvent{}, r.events[dropped:]...)
+			r.firstEvent += dropped
+		}
+		r.job.EventCount++
+		if isHole(obj) {
+			r.job.HoleCount++
+			r.job.HoleBlockCount += holeBlockCount(obj)
+		}
+	}
+
+	r.notify()
+}
+
+// saveCheckpoint records the latest checkpoint of the check, returning a
+// copy of it.
+func (r *runningJob) saveCheckpoint(checkpoint checker.Checkpoint) *jobCheckpoint {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.checkpoint = &jobCheckpoint{
+		EventCount:     r.job.EventCount,
+		HoleCount:      r.job.HoleCount,
+		HoleBlockCount: r.job.HoleBlockCount,
+		Checkpoint:     checkpoint,
+	}
+
+	saved := *r.checkpoint
+	return &saved
+}
+
+func (r *runningJob) finish(err error, canceled bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	r.job.FinishedAt = &now
+	switch {
+	case err != nil:
+		r.job.Status = JobStatusFailed
+		r.job.Error = err.Error()
+	case canceled:
+		r.job.Status = JobStatusCanceled
+	default:
+		r.job.Status = JobStatusCompleted
+	}
+
+	r.notify()
+}
+
+// notify wakes up everyone waiting on the job, must be called with the
+// lock held.
+func (r *runningJob) notify() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// flushEvents writes the buffered events to the job's events file.
+func (r *runningJob) flushEvents() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.eventsFile.flush()
+}
+
+// closeEvents flushes and closes the job's events file, once the check is
+// done.
+func (r *runningJob) closeEvents() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.eventsFile.close()
+}
+
+// current returns the job and a channel closed on the next change.
+func (r *runningJob) current() (Job, <-chan struct{}) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.job, r.changed
+}
+
+// snapshot returns the job, the events emitted from index `from` on, and
+// a channel closed on the next change. The events no longer in memory are
+// read back from the events file.
+func (r *runningJob) snapshot(from int) (Job, []JobEvent, <-chan struct{}, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var events []JobEvent
+	if from < r.firstEvent {
+		if err := r.eventsFile.flush(); err != nil {
+			return r.job, nil, r.changed, fmt.Errorf("unable to flush job %s events: %s", r.job.ID, err)
+		}
+
+		older, err := r.store.loadEvents(r.job.ID, from, r.firstEvent)
+		if err != nil {
+			return r.job, nil, r.changed, err
+		}
+		events = older
+		from = r.firstEvent
+	}
+
+	if i := from - r.firstEvent; i < len(r.events) {
+		if events == nil {
+			events = r.events[i:len(r.events):len(r.events)]
+		} else {
+			events = append(events, r.events[i:]...)
+		}
+	}
+
+	return r.job, events, r.changed, nil
+}
+
+// jobManager runs jobs and keeps them in memory until they are finished
+// and saved to the store.
+type jobManager struct {
+	store *jobStore
+
+	// onComplete, when set, is called with every job that completes and
+	// how long its last run took.
+	onComplete func(job *Job, duration time.Duration)
+
+	lock sync.Mutex
+	jobs map[string]*runningJob
+}
+
+func newJobManager(store *jobStore) *jobManager {
+	return &jobManager{
+		store: store,
+		jobs:  map[string]*runningJob{},
+	}
+}
+
+// start runs a new job, `schedule` being the name of the schedule that
+// started it, if any.
+func (m *jobManager) start(name string, params map[string]string, schedule string, c checker.Checker) (*Job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+
+	eventsFile, err := m.store.openEvents(id, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &runningJob{
+		job: Job{
+			ID:        id,
+			Check:     name,
+			Params:    params,
+			Schedule:  schedule,
+			Status:    JobStatusRunning,
+			CreatedAt: time.Now(),
+		},
+		eventsFile: eventsFile,
+	}
+
+	// The job is listed from the start, so a restart marks it interrupted
+	// even when it never reached a checkpoint.
+	if err := m.store.save(&r.job, nil); err != nil {
+		eventsFile.close()
+		return nil, fmt.Errorf("unable to save job %s: %s", id, err)
+	}
+
+	zlog.Info("job started", zap.String("job_id", id), zap.String("check", name), zap.Reflect("params", params), zap.String("schedule", schedule))
+	return m.run(r, c), nil
+}
+
+// resume runs a stored job's check again from the job's last checkpoint,
+// keeping the events emitted up to it.
+func (m *jobManager) resume(job *Job, checkpoint *jobCheckpoint, c checker.Resumable) (*Job, error) {
+	eventsFile, err := m.store.openEvents(job.ID, checkpoint.EventCount)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	resumed := *job
+	resumed.Status = JobStatusRunning
+	resumed.Error = ""
+	resumed.FinishedAt = nil
+	resumed.ResumedAt = &now
+	resumed.EventCount = checkpoint.EventCount
+	resumed.HoleCount = checkpoint.HoleCount
+	resumed.HoleBlockCount = checkpoint.HoleBlockCount
+
+	resumeFrom := checkpoint.Checkpoint
+	c.Checkpoints().ResumeFrom = &resumeFrom
+
+	r := &runningJob{
+		job:        resumed,
+		eventsFile: eventsFile,
+		firstEvent: checkpoint.EventCount,
+		checkpoint: checkpoint,
+	}
+
+	zlog.Info("job resumed", zap.String("job_id", job.ID), zap.String("check", job.Check), zap.Uint32("next_block", resumeFrom.NextBlock))
+	return m.run(r, c), nil
+}
+
+// run runs the job's check in the background, returning a copy of the
+// job. Resumable checks have their checkpoints persisted along with the
+// job, so the job can be resumed after a restart.
+func (m *jobManager) run(r *runningJob, c checker.Checker) *Job {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.store = m.store
+	r.changed = make(chan struct{})
+	r.cancel = cancel
+
+	id := r.job.ID
+	if resumable, ok := c.(checker.Resumable); ok {
+		var lastSave time.Time
+		resumable.Checkpoints().OnCheckpoint = func(checkpoint checker.Checkpoint) {
+			saved := r.saveCheckpoint(checkpoint)
+			if time.Since(lastSave) < checkpointSaveInterval {
+				return
+			}
+			lastSave = time.Now()
+
+			// The events the checkpoint counts must be on disk before it.
+			if err := r.flushEvents(); err != nil {
+				zlog.Warn("unable to flush job events", zap.String("job_id", id), zap.Error(err))
+				return
+			}
+
+			job, _ := r.current()
+			if err := m.store.save(&job, saved); err != nil {
+				zlog.Warn("unable to save job checkpoint", zap.String("job_id", id), zap.Error(err))
+			}
+		}
+	}
+
+	job := r.job
+
+	m.lock.Lock()
+	m.jobs[id] = r
+	m.lock.Unlock()
+
+	go func() {
+		defer cancel()
+
+		startTime := time.Now()
+		err := c.Check(ctx, r)
+		r.finish(err, ctx.Err() != nil)
+
+		job, _ := r.current()
+		zlog.Info("job finished", zap.String("job_id", id), zap.String("status", job.Status), zap.Error(err))
+
+		if job.Status == JobStatusCompleted && m.onComplete != nil {
+			m.onComplete(&job, time.Since(startTime))
+		}
+
+		// A job that did not complete keeps its last checkpoint, so it can
+		// be resumed later on.
+		var checkpoint *jobCheckpoint
+		if job.Status != JobStatusCompleted {
+			r.lock.Lock()
+			checkpoint = r.checkpoint
+			r.lock.Unlock()
+		}
+
+		if err := r.closeEvents(); err != nil {
+			zlog.Error("unable to write job events, keeping it in memory", zap.String("job_id", id), zap.Error(err))
+			return
+		}
+
+		if err := m.store.save(&job, checkpoint); err != nil {
+			zlog.Error("unable to save job, keeping it in memory", zap.String("job_id", id), zap.Error(err))
+			return
+		}
+
+		m.lock.Lock()
+		delete(m.jobs, id)
+		m.lock.Unlock()
+	}()
+
+	return &job
+}
+
+// resumeStored resumes a stored job from its last checkpoint. `found` is
+// false when the store does not hold the job, an error is returned when
+// the job cannot be resumed.
+func (m *jobManager) resumeStored(id string, factories map[string]checkFactory) (job *Job, found bool, err error) {
+	if m.running(id) != nil {
+		return nil, true, fmt.Errorf("job %s is already running", id)
+	}
+
+	stored, found, err := m.store.loadJob(id + ".json")
+	if err != nil || !found {
+		return nil, found, err
+	}
+
+	checkpoint, err := m.store.loadCheckpoint(id)
+	if err != nil {
+		return nil, true, err
+	}
+	if checkpoint == nil {
+		return nil, true, fmt.Errorf("job %s has no checkpoint to resume from", id)
+	}
+
+	factory, ok := factories[stored.Check]
+	if !ok {
+		return nil, true, fmt.Errorf("unknown check %q", stored.Check)
+	}
+
+	c, err := factory(func(name string) string { return stored.Params[name] })
+	if err != nil {
+		return nil, true, err
+	}
+
+	resumable, ok := c.(checker.Resumable)
+	if !ok {
+		return nil, true, fmt.Errorf("check %s cannot be resumed", stored.Check)
+	}
+
+	job, err = m.resume(stored, checkpoint, resumable)
+	return job, true, err
+}
+
+// resumeInterrupted resumes the stored jobs that were still running when
+// the server stopped. The ones that cannot be resumed are marked as
+// interrupted.
+func (m *jobManager) resumeInterrupted(factories map[string]checkFactory) {
+	jobs, err := m.store.list()
+	if err != nil {
+		zlog.Error("unable to list stored jobs", zap.Error(err))
+		return
+	}
+
+	for _, job := range jobs {
+		if job.Status != JobStatusRunning {
+			continue
+		}
+
+		_, _, err := m.resumeStored(job.ID, factories)
+		if err == nil {
+			continue
+		}
+
+		zlog.Info("unable to resume interrupted job", zap.String("job_id", job.ID), zap.Error(err))
+		checkpoint, _ := m.store.loadCheckpoint(job.ID)
+		if eventCount, err := m.store.recoverEvents(job.ID); err != nil {
+			zlog.Error("unable to recover interrupted job events", zap.String("job_id", job.ID), zap.Error(err))
+		} else {
+			job.EventCount = eventCount
+		}
+		job.Status = JobStatusInterrupted
+		if err := m.store.save(job, checkpoint); err != nil {
+			zlog.Error("unable to save interrupted job", zap.String("job_id", job.ID), zap.Error(err))
+		}
+	}
+}
+
+func (m *jobManager) running(id string) *runningJob {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.jobs[id]
+}
+
+// wait blocks until the job is no longer running, then returns it along
+// with its events.
+func (m *jobManager) wait(ctx context.Context, id string) (*Job, []JobEvent, error) {
+	for {
+		r := m.running(id)
+		if r == nil {
+			job, events, found, err := m.store.load(id)
+			if err == nil && !found {
+				err = fmt.Errorf("job %s not found", id)
+			}
+			return job, events, err
+		}
+
+		job, changed := r.current()
+		if job.Status != JobStatusRunning {
+			job, events, _, err := r.snapshot(0)
+			if err != nil {
+				return nil, nil, err
+			}
+			return &job, events, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// get returns a job and its events, whether it is running or stored.
+func (m *jobManager) get(id string) (job *Job, events []JobEvent, found bool, err error) {
+	if r := m.running(id); r != nil {
+		snapshot, events, _, err := r.snapshot(0)
+		if err != nil {
+			return nil, nil, true, err
+		}
+		return &snapshot, events, true, nil
+	}
+
+	return m.store.load(id)
+}
+
+// list returns the jobs still in memory followed by the stored ones.
+func (m *jobManager) list() ([]*Job, error) {
+	var jobs []*Job
+
+	m.lock.Lock()
+	for _, r := range m.jobs {
+		job, _ := r.current()
+		jobs = append(jobs, &job)
+	}
+	m.lock.Unlock()
+
+	stored, err := m.store.list()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, job := range stored {
+		if m.running(job.ID) == nil {
+			jobs = append(jobs, job)
+		}
+	}
+
+	return jobs, nil
+}
+
+func newJobID() (string, error) {
+	random := make([]byte, 4)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("unable to generate job ID: %s", err)
+	}
+
+	return time.Now().UTC().Format("20060102-150405") + "-" + hex.EncodeToString(random), nil
+}
+
+type createJobRequest struct {
+	Check  string            `json:"check"`
+	Params map[string]string `json:"params"`
+}
+
+// createJob implements `POST /api/jobs`, starting the named check with its
+// parameters, keyed like the `/api/*` query parameters.
+func (d *Diagnose) createJob(w http.ResponseWriter, req *http.Request) {
+	var request createJobRequest
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		http.Error(w, fmt.Sprintf("invalid job request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	factory, found := d.checkFactories()[request.Check]
+	if !found {
+		http.Error(w, fmt.Sprintf("unknown check %q", request.Check), http.StatusBadRequest)
+		return
+	}
+
+	c, err := factory(func(name string) string { return request.Params[name] })
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	job, err := d.jobs.start(request.Check, request.Params, "", c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(job)
+}
+
+func (d *Diagnose) listJobs(w http.ResponseWriter, req *http.Request) {
+	jobs, err := d.jobs.list()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(jobs)
+}
+
+// jobDetails is a job along with the `BlockRange` payloads it emitted.
+type jobDetails struct {
+	*Job
+	BlockRanges []json.RawMessage `json:"blockRanges"`
+}
+
+func (d *Diagnose) getJob(w http.ResponseWriter, req *http.Request) {
+	job, events, found, err := d.jobs.get(mux.Vars(req)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+
+	details := jobDetails{Job: job, BlockRanges: []json.RawMessage{}}
+	for _, event := range events {
+		if event.Type == WebsocketTypeBlockRange {
+			details.BlockRanges = append(details.BlockRanges, event.Payload)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(details)
+}
+
+// resumeJob implements `POST /api/jobs/{id}/resume`, running a job that
+// did not complete again from its last checkpoint.
+func (d *Diagnose) resumeJob(w http.ResponseWriter, req *http.Request) {
+	job, found, err := d.jobs.resumeStored(mux.Vars(req)["id"], d.checkFactories())
+	switch {
+	case err != nil && !found:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	case !found:
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(job)
+}
+
+func (d *Diagnose) cancelJob(w http.ResponseWriter, req *http.Request) {
+	r := d.jobs.running(mux.Vars(req)["id"])
+	if r == nil {
+		http.Error(w, "job not running", http.StatusNotFound)
+		return
+	}
+
+	r.cancel()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// streamJob attaches a websocket to a job, replaying every event already
+// emitted then following the job until it finishes. The final job is sent
+// last, as a `Job` message.
+func (d *Diagnose) streamJob(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+
+	r := d.jobs.running(id)
+	var stored *Job
+	var storedEvents []JobEvent
+	if r == nil {
+		var found bool
+		var err error
+		stored, storedEvents, found, err = d.jobs.store.load(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	conn, err := d.upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	go readWebsocket(conn, cancel)
+
+	if r == nil {
+		sendJobEvents(conn, storedEvents)
+		maybeSendWebsocket(conn, WebsocketTypeJob, stored)
+		return
+	}
+
+	next := 0
+	var lastProgress *checker.Progress
+	for {
+		job, events, changed, err := r.snapshot(next)
+		if err != nil {
+			zlog.Info("cannot read job events", zap.String("job_id", id), zap.Error(err))
+			return
+		}
+		if err := sendJobEvents(conn, events); err != nil {
+			return
+		}
+		next += len(events)
+
+		if job.Progress != nil && job.Progress != lastProgress {
+			lastProgress = job.Progress
+			maybeSendWebsocket(conn, WebsocketTypeProgress, job.Progress)
+		}
+
+		if job.Status != JobStatusRunning {
+			maybeSendWebsocket(conn, WebsocketTypeJob, &job)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		}
+	}
+}
+
+func sendJobEvents(conn *websocket.Conn, events []JobEvent) error {
+	for _, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+
+		if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			zlog.Info("cannot send job event", zap.Error(err))
+			return err
+		}
+	}
+
+	return nil
+}
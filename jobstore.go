@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const checkpointFileSuffix = ".checkpoint.json"
+
+// jobStore keeps jobs on disk, one `<id>.json` file holding the
+// job itself and one `<id>.events.ndjson` file holding every event it
+// emitted, one per line, so listing jobs does not read their events. The
+// events are appended to their file as the job emits them. Jobs that can
+// be resumed also have a `<id>.checkpoint.json` file.
+type jobStore struct {
+	path string
+}
+
+func newJobStore(path string) *jobStore {
+	return &jobStore{path: path}
+}
+
+// jobEventsFile appends the events of a running job to its events file.
+type jobEventsFile struct {
+	file    *os.File
+	writer  *bufio.Writer
+	encoder *json.Encoder
+}
+
+// openEvents opens the events file of the job for appending, keeping its
+// first `keep` events and dropping the ones after them.
+func (s *jobStore) openEvents(id string, keep int) (*jobEventsFile, error) {
+	if err := os.MkdirAll(s.path, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create jobs store directory: %s", err)
+	}
+
+	path := filepath.Join(s.path, id+".events.ndjson")
+	size, err := eventsSize(path, keep)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read job %s events: %s", id, err)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open job %s events: %s", id, err)
+	}
+
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("unable to truncate job %s events: %s", id, err)
+	}
+	if _, err := file.Seek(size, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("unable to seek job %s events: %s", id, err)
+	}
+
+	writer := bufio.NewWriter(file)
+	return &jobEventsFile{file: file, writer: writer, encoder: json.NewEncoder(writer)}, nil
+}
+
+// eventsSize returns the size in bytes of the first `count` events of the
+// events file.
+func eventsSize(path string, count int) (size int64, err error) {
+	if count == 0 {
+		return 0, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for i := 0; i < count; i++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return 0, fmt.Errorf("only %d events, expected %d: %s", i, count, err)
+		}
+		size += int64(len(line))
+	}
+
+	return size, nil
+}
+
+// recoverEvents drops the partially written event ending the events file
+// of an interrupted job, if any, and returns the number of events left.
+func (s *jobStore) recoverEvents(id string) (count int, err error) {
+	path := filepath.Join(s.path, id+".events.ndjson")
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("unable to open job %s events: %s", id, err)
+	}
+	defer file.Close()
+
+	var size int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("unable to read job %s events: %s", id, err)
+		}
+		size += int64(len(line))
+		count++
+	}
+
+	if err := file.Truncate(size); err != nil {
+		return 0, fmt.Errorf("unable to truncate job %s events: %s", id, err)
+	}
+	return count, nil
+}
+
+func (f *jobEventsFile) append(event JobEvent) error {
+	if f.file == nil {
+		return fmt.Errorf("events file closed")
+	}
+	return f.encoder.Encode(event)
+}
+
+// flush writes the buffered events to the file, a closed file having none.
+func (f *jobEventsFile) flush() error {
+	if f.file == nil {
+		return nil
+	}
+	return f.writer.Flush()
+}
+
+func (f *jobEventsFile) close() error {
+	if f.file == nil {
+		return nil
+	}
+
+	err := f.writer.Flush()
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	f.file = nil
+	return err
+}
+
+// save writes the job and its checkpoint, removing the previous
+// checkpoint when `checkpoint` is nil. The events are written by the job's
+// `jobEventsFile` as they are emitted.
+func (s *jobStore) save(job *Job, checkpoint *jobCheckpoint) error {
+	if err := os.MkdirAll(s.path, 0755); err != nil {
+		return fmt.Errorf("unable to create jobs store directory: %s", err)
+	}
+
+	var err error
+	checkpointName := job.ID + checkpointFileSuffix
+	if checkpoint != nil {
+		err = s.writeFile(checkpointName, func(w *bufio.Writer) error {
+			return json.NewEncoder(w).Encode(checkpoint)
+		})
+	} else if err = os.Remove(filepath.Join(s.path, checkpointName)); os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// The job file is written last, its events being flushed beforehand, a
+	// job is only listed once its events are complete up to its count.
+	return s.writeFile(job.ID+".json", func(w *bufio.Writer) error {
+		return json.NewEncoder(w).Encode(job)
+	})
+}
+
+// writeFile writes the file through a temporary one, so a crash never
+// leaves a partial file behind.
+func (s *jobStore) writeFile(name string, write func(w *bufio.Writer) error) error {
+	tmpPath := filepath.Join(s.path, name+".tmp")
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("unable to create %s: %s", name, err)
+	}
+
+	w := bufio.NewWriter(file)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("unable to write %s: %s", name, err)
+	}
+
+	return os.Rename(tmpPath, filepath.Join(s.path, name))
+}
+
+// load returns the job and its events, `found` being false when the store
+// does not hold it.
+func (s *jobStore) load(id string) (job *Job, events []JobEvent, found bool, err error) {
+	job, found, err = s.loadJob(id + ".json")
+	if err != nil || !found {
+		return
+	}
+
+	events, err = s.loadEvents(id, 0, -1)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	return job, events, true, nil
+}
+
+// loadEvents returns the events of the job from index `from` up to, but
+// excluding, index `to`, every event from `from` on when `to` is negative.
+func (s *jobStore) loadEvents(id string, from, to int) (events []JobEvent, err error) {
+	file, err := os.Open(filepath.Join(s.path, id+".events.ndjson"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to open job %s events: %s", id, err)
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for i := 0; decoder.More() && (to < 0 || i < to); i++ {
+		var event JobEvent
+		if err := decoder.Decode(&event); err != nil {
+			return nil, fmt.Errorf("unable to decode job %s events: %s", id, err)
+		}
+		if i >= from {
+			events = append(events, event)
+		}
+	}
+
+	return events, nil
+}
+
+// loadCheckpoint returns the last checkpoint saved for the job, nil when
+// there is none.
+func (s *jobStore) loadCheckpoint(id string) (*jobCheckpoint, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.path, id+checkpointFileSuffix))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read job %s checkpoint: %s", id, err)
+	}
+
+	checkpoint := &jobCheckpoint{}
+	if err := json.Unmarshal(data, checkpoint); err != nil {
+		return nil, fmt.Errorf("unable to decode job %s checkpoint: %s", id, err)
+	}
+
+	return checkpoint, nil
+}
+
+func (s *jobStore) loadJob(name string) (*Job, bool, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.path, name))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to read %s: %s", name, err)
+	}
+
+	job := &Job{}
+	if err := json.Unmarshal(data, job); err != nil {
+		return nil, false, fmt.Errorf("unable to decode %s: %s", name, err)
+	}
+
+	return job, true, nil
+}
+
+// list returns every stored job, most recent first.
+func (s *jobStore) list() ([]*Job, error) {
+	files, err := ioutil.ReadDir(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to list jobs store: %s", err)
+	}
+
+	var jobs []*Job
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, ".json") || strings.HasSuffix(name, checkpointFileSuffix) {
+			continue
+		}
+
+		job, found, err := s.loadJob(name)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			jobs = append(jobs, job)
+		}
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.After(jobs[j].CreatedAt)
+	})
+
+	return jobs, nil
+}
@@ -1,14 +1,10 @@
 package main
 
 import (
-	"context"
 	"fmt"
-	"math"
 	"net/http"
-	"time"
 
-	bt "cloud.google.com/go/bigtable"
-	"github.com/eoscanada/diagnose/utils"
+	"github.com/eoscanada/diagnose/checker"
 	"github.com/eoscanada/kvdb"
 	"github.com/eoscanada/kvdb/eosdb"
 	"github.com/eoscanada/kvdb/ethdb"
@@ -16,420 +12,251 @@ import (
 )
 
 func (d *Diagnose) EOSKVDBBlocks(w http.ResponseWriter, req *http.Request) {
-	kvdbInfo, db := d.getEOSDatabase(w, req)
-	if kvdbInfo == nil || db == nil {
-		return
+	d.serveCheck(w, req, d.newEOSKVDBBlocks)
+}
+
+func (d *Diagnose) newEOSKVDBBlocks(param paramFunc) (checker.Checker, error) {
+	kvdbInfo, db, err := d.getEOSDatabase(param)
+	if err != nil {
+		return nil, err
 	}
 
-	zlog.Info("diagnose - EOS  - KVDB Block Hole Checker", zap.Reflect("connection_info", kvdbInfo))
-	conn, err := d.upgrader.Upgrade(w, req, nil)
+	startBlock, stopBlock, err := blockBounds(param)
 	if err != nil {
-		return
+		return nil, err
 	}
-	defer conn.Close()
-
-	ctx, cancel := context.WithCancel(req.Context())
-
-	count := int64(0)
-	started := false
-	previousNum := int64(0)
-	batchHighBlockNum := int64(0)
-	currentBlockNum := int64(0)
-
-	startTime := time.Now()
-	batchStartTime := time.Now()
-
-	go readWebsocket(conn, cancel)
-
-	maybeSendWebsocket(conn, WebsocketTypeProgress, Progress{Elapsed: time.Now().Sub(startTime)})
-	db.Blocks.BaseTable.ReadRows(ctx, bt.InfiniteRange(""), func(row bt.Row) bool {
-		count++
-
-		currentBlockNum = int64(math.MaxUint32 - kvdb.BlockNum(row.Key()))
-
-		if count%5000 == 0 {
-			maybeSendWebsocket(conn, WebsocketTypeProgress, Progress{Elapsed: time.Now().Sub(startTime)})
-		}
-
-		if !started {
-			previousNum = currentBlockNum + 1
-			batchStartTime = time.Now()
-			batchHighBlockNum = currentBlockNum
-
-		}
-
-		difference := previousNum - currentBlockNum
-
-		if difference > 1 && started {
-
-			msg := fmt.Sprintf("%d rows read", (uint32(batchHighBlockNum) - uint32(currentBlockNum+1)))
-			maybeSendWebsocket(conn, WebsocketTypeBlockRange, &BlockRange{
-				StarBlock: uint32(currentBlockNum + 1),
-				EndBlock:  uint32(batchHighBlockNum),
-				Message:   "",
-				Status:    BlockRangeStatusValid,
-			})
-			msg = fmt.Sprintf("Found block hole %d rows", (uint32(previousNum-1) - uint32(currentBlockNum+1)))
-			maybeSendWebsocket(conn, WebsocketTypeBlockRange, &BlockRange{
-				StarBlock: uint32(currentBlockNum + 1),
-				EndBlock:  uint32(previousNum - 1),
-				Message:   msg,
-				Status:    BlockRangeStatusHole,
-			})
-			batchHighBlockNum = currentBlockNum
-		}
-
-		previousNum = currentBlockNum
-
-		if count%200000 == 0 {
-			now := time.Now()
-			msg := fmt.Sprintf("%d rows read (batch %s, total %s)", (uint32(batchHighBlockNum) - uint32(currentBlockNum)), now.Sub(batchStartTime), now.Sub(startTime))
-			maybeSendWebsocket(conn, WebsocketTypeBlockRange, &BlockRange{
-				StarBlock: uint32(currentBlockNum),
-				EndBlock:  uint32(batchHighBlockNum),
-				Message:   msg,
-				Status:    BlockRangeStatusValid,
-			})
-			batchStartTime = time.Now()
-			batchHighBlockNum = (currentBlockNum - 1)
-		}
-
-		started = true
-
-		return true
-	}, bt.RowFilter(bt.StripValueFilter()))
-	now := time.Now()
-	msg := fmt.Sprintf("%d rows read (batch %s, total %s)", (uint32(batchHighBlockNum) - uint32(currentBlockNum)), now.Sub(batchStartTime), now.Sub(startTime))
-	maybeSendWebsocket(conn, WebsocketTypeBlockRange, &BlockRange{
-		StarBlock: uint32(currentBlockNum),
-		EndBlock:  uint32(batchHighBlockNum),
-		Message:   msg,
-		Status:    BlockRangeStatusValid,
-	})
-	zlog.Info("diagnose - EOS  - KVDB Block Hole Checker - Completed")
+
+	concurrency, err := concurrencyParam(param)
+	if err != nil {
+		return nil, err
+	}
+
+	zlog.Info("diagnose - EOS  - KVDB Block Hole Checker", zap.Reflect("connection_info", kvdbInfo))
+	return &checker.EOSKVDBBlocks{
+		DB:          db,
+		StartBlock:  startBlock,
+		StopBlock:   stopBlock,
+		Concurrency: concurrency,
+	}, nil
 }
 
 func (d *Diagnose) EOSKVDBBlocksValidation(w http.ResponseWriter, req *http.Request) {
-	kvdbInfo, db := d.getEOSDatabase(w, req)
-	if kvdbInfo == nil || db == nil {
-		return
+	d.serveCheck(w, req, d.newEOSKVDBBlocksValidation)
+}
+
+func (d *Diagnose) newEOSKVDBBlocksValidation(param paramFunc) (checker.Checker, error) {
+	kvdbInfo, db, err := d.getEOSDatabase(param)
+	if err != nil {
+		return nil, err
 	}
 
-	zlog.Info("diagnose - EOS  - KVDB Block Validation", zap.Reflect("connection_info", kvdbInfo))
+	startBlock, stopBlock, err := blockBounds(param)
+	if err != nil {
+		return nil, err
+	}
 
-	conn, err := d.upgrader.Upgrade(w, req, nil)
+	concurrency, err := concurrencyParam(param)
 	if err != nil {
-		return
+		return nil, err
 	}
-	defer conn.Close()
-
-	ctx, cancel := context.WithCancel(req.Context())
-
-	count := int64(0)
-	started := false
-	previousNum := int64(0)
-	batchHighBlockNum := int64(0)
-	currentBlockNum := int64(0)
-
-	startTime := time.Now()
-	batchStartTime := time.Now()
-
-	go readWebsocket(conn, cancel)
-
-	maybeSendWebsocket(conn, WebsocketTypeProgress, Progress{Elapsed: time.Now().Sub(startTime)})
-
-	db.Blocks.BaseTable.ReadRows(ctx, bt.InfiniteRange(""), func(row bt.Row) bool {
-		count++
-
-		currentBlockNum = int64(math.MaxUint32 - kvdb.BlockNum(row.Key()))
-
-		isValid := utils.HasAllColumns(row, db.Blocks.ColBlock, db.Blocks.ColMetaIrreversible, db.Blocks.ColMetaWritten, db.Blocks.ColTransactionRefs, db.Blocks.ColTransactionTraceRefs)
-		if count%5000 == 0 {
-			maybeSendWebsocket(conn, WebsocketTypeProgress, Progress{Elapsed: time.Now().Sub(startTime)})
-		}
-
-		if !started {
-			previousNum = currentBlockNum + 1
-			batchStartTime = time.Now()
-			batchHighBlockNum = currentBlockNum
-		}
-
-		difference := previousNum - currentBlockNum
-
-		if difference > 1 && started && isValid {
-			msg := fmt.Sprintf("Found missing columns(s) %d rows", (uint32(previousNum-1) - uint32(currentBlockNum+1)))
-			maybeSendWebsocket(conn, WebsocketTypeBlockRange, &BlockRange{
-				StarBlock: uint32(currentBlockNum + 1),
-				EndBlock:  uint32(previousNum - 1),
-				Message:   msg,
-				Status:    BlockRangeStatusHole,
-			})
-			batchHighBlockNum = currentBlockNum
-		}
-
-		if isValid {
-			previousNum = currentBlockNum
-		}
-
-		if count%200000 == 0 {
-			now := time.Now()
-			msg := fmt.Sprintf("%d rows read (batch %s, total %s)", (uint32(batchHighBlockNum) - uint32(currentBlockNum)), now.Sub(batchStartTime), now.Sub(startTime))
-			maybeSendWebsocket(conn, WebsocketTypeBlockRange, &BlockRange{
-				StarBlock: uint32(currentBlockNum),
-				EndBlock:  uint32(batchHighBlockNum),
-				Message:   msg,
-				Status:    BlockRangeStatusValid,
-			})
-			batchStartTime = time.Now()
-			batchHighBlockNum = (currentBlockNum - 1)
-		}
-
-		started = true
-
-		return true
-	}, bt.RowFilter(bt.StripValueFilter()))
-	now := time.Now()
-	msg := fmt.Sprintf("%d rows read (batch %s, total %s)", (uint32(batchHighBlockNum) - uint32(currentBlockNum)), now.Sub(batchStartTime), now.Sub(startTime))
-	maybeSendWebsocket(conn, WebsocketTypeBlockRange, &BlockRange{
-		StarBlock: uint32(currentBlockNum),
-		EndBlock:  uint32(batchHighBlockNum),
-		Message:   msg,
-		Status:    BlockRangeStatusValid,
-	})
-	zlog.Info("diagnose - EOS  - KVDB Block Validation - Completed")
 
+	zlog.Info("diagnose - EOS  - KVDB Block Validation", zap.Reflect("connection_info", kvdbInfo))
+	return &checker.EOSKVDBBlocksValidation{
+		DB:          db,
+		StartBlock:  startBlock,
+		StopBlock:   stopBlock,
+		Concurrency: concurrency,
+	}, nil
 }
 
 func (d *Diagnose) ETHKVDBBlocks(w http.ResponseWriter, req *http.Request) {
-	kvdbInfo, db := d.getETHDatabase(w, req)
-	if kvdbInfo == nil || db == nil {
-		return
+	d.serveCheck(w, req, d.newETHKVDBBlocks)
+}
+
+func (d *Diagnose) newETHKVDBBlocks(param paramFunc) (checker.Checker, error) {
+	kvdbInfo, db, err := d.getETHDatabase(param)
+	if err != nil {
+		return nil, err
 	}
 
-	zlog.Info("diagnose - ETH  - KVDB Block Hole Checker", zap.Reflect("connection_info", kvdbInfo))
+	startBlock, stopBlock, err := blockBounds(param)
+	if err != nil {
+		return nil, err
+	}
 
-	conn, err := d.upgrader.Upgrade(w, req, nil)
+	concurrency, err := concurrencyParam(param)
 	if err != nil {
-		return
+		return nil, err
 	}
-	defer conn.Close()
-
-	ctx, cancel := context.WithCancel(req.Context())
-
-	count := int64(0)
-	started := false
-	previousNum := uint64(0)
-	batchHighBlockNum := uint64(0)
-	currentBlockNum := uint64(0)
-
-	startTime := time.Now()
-	batchStartTime := time.Now()
-
-	go readWebsocket(conn, cancel)
-	maybeSendWebsocket(conn, WebsocketTypeProgress, Progress{Elapsed: time.Now().Sub(startTime)})
-	// You can test on a lower range with `bt.NewRange("ff76abbf", "ff76abcf")`
-	db.Blocks.BaseTable.ReadRows(ctx, bt.InfiniteRange("blkn:"), func(row bt.Row) bool {
-		count++
-
-		currentBlockNum, _, err = ethdb.Keys.ReadBlockNum(row.Key())
-		if err != nil {
-			return false
-		}
-
-		if count%5000 == 0 {
-			maybeSendWebsocket(conn, WebsocketTypeProgress, Progress{Elapsed: time.Now().Sub(startTime)})
-		}
-
-		if !started {
-			previousNum = currentBlockNum + 1
-			batchStartTime = time.Now()
-			batchHighBlockNum = currentBlockNum
-		}
-
-		difference := previousNum - currentBlockNum
-
-		if difference > 1 && started {
-			msg := fmt.Sprintf("Found block hole %d rows", (uint32(previousNum-1) - uint32(currentBlockNum+1)))
-			maybeSendWebsocket(conn, WebsocketTypeBlockRange, &BlockRange{
-				StarBlock: uint32(currentBlockNum + 1),
-				EndBlock:  uint32(previousNum - 1),
-				Message:   msg,
-				Status:    BlockRangeStatusHole,
-			})
-			batchHighBlockNum = currentBlockNum
-		}
-
-		previousNum = currentBlockNum
-
-		if count%200000 == 0 {
-			now := time.Now()
-			msg := fmt.Sprintf("%d rows read (batch %s, total %s)", (uint32(batchHighBlockNum) - uint32(currentBlockNum)), now.Sub(batchStartTime), now.Sub(startTime))
-			maybeSendWebsocket(conn, WebsocketTypeBlockRange, &BlockRange{
-				StarBlock: uint32(currentBlockNum),
-				EndBlock:  uint32(batchHighBlockNum),
-				Message:   msg,
-				Status:    BlockRangeStatusValid,
-			})
-			batchStartTime = time.Now()
-			batchHighBlockNum = (currentBlockNum - 1)
-		}
-
-		started = true
-
-		return true
-	}, bt.RowFilter(bt.StripValueFilter()))
-	now := time.Now()
-	msg := fmt.Sprintf("%d rows read (batch %s, total %s)", (uint32(batchHighBlockNum) - uint32(currentBlockNum)), now.Sub(batchStartTime), now.Sub(startTime))
-	maybeSendWebsocket(conn, WebsocketTypeBlockRange, &BlockRange{
-		StarBlock: uint32(currentBlockNum),
-		EndBlock:  uint32(batchHighBlockNum),
-		Message:   msg,
-		Status:    BlockRangeStatusValid,
-	})
-
-	zlog.Info("diagnose - ETH  - KVDB Block Hole Checker  - Completed")
+
+	zlog.Info("diagnose - ETH  - KVDB Block Hole Checker", zap.Reflect("connection_info", kvdbInfo))
+	return &checker.ETHKVDBBlocks{
+		DB:          db,
+		StartBlock:  startBlock,
+		StopBlock:   stopBlock,
+		Concurrency: concurrency,
+	}, nil
 }
 
 func (d *Diagnose) ETHKVDBBlockValidation(w http.ResponseWriter, req *http.Request) {
-	kvdbInfo, db := d.getETHDatabase(w, req)
-	if kvdbInfo == nil || db == nil {
-		return
+	d.serveCheck(w, req, d.newETHKVDBBlocksValidation)
+}
+
+func (d *Diagnose) newETHKVDBBlocksValidation(param paramFunc) (checker.Checker, error) {
+	kvdbInfo, db, err := d.getETHDatabase(param)
+	if err != nil {
+		return nil, err
+	}
+
+	startBlock, stopBlock, err := blockBounds(param)
+	if err != nil {
+		return nil, err
+	}
+
+	concurrency, err := concurrencyParam(param)
+	if err != nil {
+		return nil, err
 	}
 
 	zlog.Info("diagnose - ETH  - KVDB Block Validation", zap.Reflect("connection_info", kvdbInfo))
+	return &checker.ETHKVDBBlocksValidation{
+		DB:          db,
+		StartBlock:  startBlock,
+		StopBlock:   stopBlock,
+		Concurrency: concurrency,
+	}, nil
+}
+
+func (d *Diagnose) EOSKVDBIrreversibility(w http.ResponseWriter, req *http.Request) {
+	d.serveCheck(w, req, d.newEOSKVDBIrreversibility)
+}
 
-	conn, err := d.upgrader.Upgrade(w, req, nil)
+func (d *Diagnose) newEOSKVDBIrreversibility(param paramFunc) (checker.Checker, error) {
+	kvdbInfo, db, err := d.getEOSDatabase(param)
 	if err != nil {
-		return
+		return nil, err
 	}
-	defer conn.Close()
-
-	ctx, cancel := context.WithCancel(req.Context())
-
-	count := int64(0)
-	started := false
-	previousNum := uint64(0)
-	batchHighBlockNum := uint64(0)
-	currentBlockNum := uint64(0)
-
-	startTime := time.Now()
-	batchStartTime := time.Now()
-
-	go readWebsocket(conn, cancel)
-
-	maybeSendWebsocket(conn, WebsocketTypeProgress, Progress{Elapsed: time.Now().Sub(startTime)})
-	db.Blocks.BaseTable.ReadRows(ctx, bt.InfiniteRange("blkn:"), func(row bt.Row) bool {
-		count++
-
-		currentBlockNum, _, err = ethdb.Keys.ReadBlockNum(row.Key())
-		if err != nil {
-			return false
-		}
-
-		isValid := utils.HasAllColumns(row, db.Blocks.ColHeaderProto, db.Blocks.ColMetaIrreversible, db.Blocks.ColMetaMapping, db.Blocks.ColMetaWritten, db.Blocks.ColTrxRefsProto, db.Blocks.ColUnclesProto)
-		if count%5000 == 0 {
-			maybeSendWebsocket(conn, WebsocketTypeProgress, Progress{Elapsed: time.Now().Sub(startTime)})
-		}
-
-		if !started {
-			previousNum = currentBlockNum + 1
-			batchStartTime = time.Now()
-			batchHighBlockNum = currentBlockNum
-		}
-
-		difference := previousNum - currentBlockNum
-
-		if difference > 1 && started && isValid {
-			msg := fmt.Sprintf("%d rows read", (uint32(batchHighBlockNum) - uint32(currentBlockNum+1)))
-			maybeSendWebsocket(conn, WebsocketTypeBlockRange, &BlockRange{
-				StarBlock: uint32(currentBlockNum + 1),
-				EndBlock:  uint32(batchHighBlockNum),
-				Message:   "",
-				Status:    BlockRangeStatusValid,
-			})
-			msg = fmt.Sprintf("Found missing column(s) %d rows\n", (uint32(previousNum-1) - uint32(currentBlockNum+1)))
-			maybeSendWebsocket(conn, WebsocketTypeBlockRange, &BlockRange{
-				StarBlock: uint32(currentBlockNum + 1),
-				EndBlock:  uint32(previousNum - 1),
-				Message:   msg,
-				Status:    BlockRangeStatusHole,
-			})
-			batchHighBlockNum = currentBlockNum
-		}
-
-		if isValid {
-			previousNum = currentBlockNum
-		}
-
-		if count%200000 == 0 {
-			now := time.Now()
-			msg := fmt.Sprintf("%d rows read (batch %s, total %s)\n", (uint32(batchHighBlockNum) - uint32(currentBlockNum)), now.Sub(batchStartTime), now.Sub(startTime))
-			maybeSendWebsocket(conn, WebsocketTypeBlockRange, &BlockRange{
-				StarBlock: uint32(currentBlockNum),
-				EndBlock:  uint32(batchHighBlockNum),
-				Message:   msg,
-				Status:    BlockRangeStatusValid,
-			})
-			batchStartTime = time.Now()
-			batchHighBlockNum = (currentBlockNum - 1)
-		}
-
-		started = true
-
-		return true
-	}, bt.RowFilter(bt.StripValueFilter()))
-	now := time.Now()
-	msg := fmt.Sprintf("%d rows read (batch %s, total %s)\n", (uint32(batchHighBlockNum) - uint32(currentBlockNum)), now.Sub(batchStartTime), now.Sub(startTime))
-	maybeSendWebsocket(conn, WebsocketTypeBlockRange, &BlockRange{
-		StarBlock: uint32(currentBlockNum),
-		EndBlock:  uint32(batchHighBlockNum),
-		Message:   msg,
-		Status:    BlockRangeStatusValid,
-	})
-	zlog.Info("diagnose - ETH  - KVDB Block Validation - Completed")
+
+	startBlock, stopBlock, err := blockBounds(param)
+	if err != nil {
+		return nil, err
+	}
+
+	zlog.Info("diagnose - EOS  - KVDB Irreversibility", zap.Reflect("connection_info", kvdbInfo))
+	return &checker.EOSKVDBIrreversibility{
+		DB:         db,
+		StartBlock: startBlock,
+		StopBlock:  stopBlock,
+	}, nil
+}
+
+func (d *Diagnose) ETHKVDBIrreversibility(w http.ResponseWriter, req *http.Request) {
+	d.serveCheck(w, req, d.newETHKVDBIrreversibility)
+}
+
+func (d *Diagnose) newETHKVDBIrreversibility(param paramFunc) (checker.Checker, error) {
+	kvdbInfo, db, err := d.getETHDatabase(param)
+	if err != nil {
+		return nil, err
+	}
+
+	startBlock, stopBlock, err := blockBounds(param)
+	if err != nil {
+		return nil, err
+	}
+
+	zlog.Info("diagnose - ETH  - KVDB Irreversibility", zap.Reflect("connection_info", kvdbInfo))
+	return &checker.ETHKVDBIrreversibility{
+		DB:         db,
+		StartBlock: startBlock,
+		StopBlock:  stopBlock,
+	}, nil
+}
+
+func (d *Diagnose) EOSKVDBForks(w http.ResponseWriter, req *http.Request) {
+	d.serveCheck(w, req, d.newEOSKVDBForks)
+}
+
+func (d *Diagnose) newEOSKVDBForks(param paramFunc) (checker.Checker, error) {
+	kvdbInfo, db, err := d.getEOSDatabase(param)
+	if err != nil {
+		return nil, err
+	}
+
+	startBlock, stopBlock, err := blockBounds(param)
+	if err != nil {
+		return nil, err
+	}
+
+	zlog.Info("diagnose - EOS  - KVDB Forks", zap.Reflect("connection_info", kvdbInfo))
+	return &checker.EOSKVDBForks{
+		DB:         db,
+		StartBlock: startBlock,
+		StopBlock:  stopBlock,
+	}, nil
+}
+
+func (d *Diagnose) ETHKVDBForks(w http.ResponseWriter, req *http.Request) {
+	d.serveCheck(w, req, d.newETHKVDBForks)
+}
+
+func (d *Diagnose) newETHKVDBForks(param paramFunc) (checker.Checker, error) {
+	kvdbInfo, db, err := d.getETHDatabase(param)
+	if err != nil {
+		return nil, err
+	}
+
+	startBlock, stopBlock, err := blockBounds(param)
+	if err != nil {
+		return nil, err
+	}
+
+	zlog.Info("diagnose - ETH  - KVDB Forks", zap.Reflect("connection_info", kvdbInfo))
+	return &checker.ETHKVDBForks{
+		DB:         db,
+		StartBlock: startBlock,
+		StopBlock:  stopBlock,
+	}, nil
 }
 
-func (d *Diagnose) extractConnectionInfo(w http.ResponseWriter, req *http.Request) *kvdb.ConnectionInfo {
-	connectionInfo := getQueryParam(req, "connection_info")
+func (d *Diagnose) extractConnectionInfo(param paramFunc) (*kvdb.ConnectionInfo, error) {
+	connectionInfo := param("connection_info")
 	if connectionInfo == "" {
 		connectionInfo = d.KvdbConnectionInfo
 	}
 
 	kvdbInfo, err := kvdb.NewConnectionInfo(connectionInfo)
 	if err != nil {
-		fmt.Fprintf(w, "invalid connection info: %s", err)
-		return nil
+		return nil, fmt.Errorf("invalid connection info: %s", err)
 	}
 
-	return kvdbInfo
+	return kvdbInfo, nil
 }
 
-func (d *Diagnose) getEOSDatabase(w http.ResponseWriter, req *http.Request) (*kvdb.ConnectionInfo, *eosdb.EOSDatabase) {
-	kvdbInfo := d.extractConnectionInfo(w, req)
-	if kvdbInfo == nil {
-		return nil, nil
+func (d *Diagnose) getEOSDatabase(param paramFunc) (*kvdb.ConnectionInfo, *eosdb.EOSDatabase, error) {
+	kvdbInfo, err := d.extractConnectionInfo(param)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	db, err := eosdb.New(kvdbInfo.TablePrefix, kvdbInfo.Project, kvdbInfo.Instance, false)
 	if err != nil {
-		fmt.Fprintf(w, "unable to create EOS database: %s", err)
-		return nil, nil
+		return nil, nil, fmt.Errorf("unable to create EOS database: %s", err)
 	}
 
-	return kvdbInfo, db
+	return kvdbInfo, db, nil
 }
 
-func (d *Diagnose) getETHDatabase(w http.ResponseWriter, req *http.Request) (*kvdb.ConnectionInfo, *ethdb.ETHDatabase) {
-	kvdbInfo := d.extractConnectionInfo(w, req)
-	if kvdbInfo == nil {
-		return nil, nil
+func (d *Diagnose) getETHDatabase(param paramFunc) (*kvdb.ConnectionInfo, *ethdb.ETHDatabase, error) {
+	kvdbInfo, err := d.extractConnectionInfo(param)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	db, err := ethdb.New(kvdbInfo.TablePrefix, kvdbInfo.Project, kvdbInfo.Instance, false)
 	if err != nil {
-		fmt.Fprintf(w, "unable to create ETH database: %s", err)
-		return nil, nil
+		return nil, nil, fmt.Errorf("unable to create ETH database: %s", err)
 	}
 
-	return kvdbInfo, db
+	return kvdbInfo, db, nil
 }
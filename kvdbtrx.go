@@ -1,116 +1,61 @@
 package main
 
 import (
-	"context"
-	"fmt"
-	"math"
 	"net/http"
-	"strings"
-	"time"
 
-	bt "cloud.google.com/go/bigtable"
-	"github.com/eoscanada/dhammer"
-	"github.com/eoscanada/kvdb"
+	"github.com/eoscanada/diagnose/checker"
 	"go.uber.org/zap"
 )
 
 func (d *Diagnose) EOSKVDBTrxsValidation(w http.ResponseWriter, req *http.Request) {
-	kvdbInfo, db := d.getEOSDatabase(w, req)
-	if kvdbInfo == nil || db == nil {
-		return
-	}
-
-	zlog.Info("diagnose - EOS  - KVDB Trx Validation", zap.Reflect("connection_info", kvdbInfo))
+	d.serveCheck(w, req, d.newEOSKVDBTrxsValidation)
+}
 
-	conn, err := d.upgrader.Upgrade(w, req, nil)
+func (d *Diagnose) newEOSKVDBTrxsValidation(param paramFunc) (checker.Checker, error) {
+	kvdbInfo, db, err := d.getEOSDatabase(param)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	defer conn.Close()
-
-	reqCtx, cancel := context.WithCancel(req.Context())
-	go readWebsocket(conn, cancel)
-
-	startTime := time.Now()
-
-	processRowRange := func(ctx context.Context, ranges []interface{}) ([]interface{}, error) {
-		zlog.Info("processing ranges", zap.Int("range_count", len(ranges)), zap.Reflect("ranges", ranges))
-		var results []interface{}
-		for _, r := range ranges {
-			rowRange, _ := r.(bt.RowRange)
-			db.Transactions.BaseTable.ReadRows(ctx, rowRange, func(row bt.Row) bool {
-				key := row.Key()
-				trxID := key[0:64]
-
-				results = append(results, &Transaction{
-					Prefix:   trxID[0:8],
-					Id:       trxID,
-					BlockNum: kvdb.BlockNum(key[65:73]),
-				})
-				return true
-			}, bt.RowFilter(bt.ConditionFilter(bt.ColumnFilter("written"), nil, bt.StripValueFilter())))
-		}
-		zlog.Info("finished process ranges", zap.Int("trx_count", len(results)))
-		return results, nil
+	startBlock, stopBlock, err := blockBounds(param)
+	if err != nil {
+		return nil, err
 	}
 
-	concurrency := 16
-	zlog.Info("concurrency count", zap.Int("concurrency_count", concurrency))
-
-	rowRanges := createTrxRowSets(concurrency)
-
-	hammer := dhammer.NewHammer(1, len(rowRanges), processRowRange)
-	hammer.Start(reqCtx)
-	maybeSendWebsocket(conn, WebsocketTypeProgress, Progress{Elapsed: time.Now().Sub(startTime)})
-
-	for _, rowRange := range rowRanges {
-		zlog.Info("pushing in hammer", zap.Reflect("row_range", rowRange.String()))
-		maybeSendWebsocket(conn, WebsocketTypeMessage, &Message{
-			Msg: fmt.Sprintf("Processing group range: start %s", rowRange.String()),
-		})
-		hammer.In <- rowRange
+	orphans, err := boolParam(param, "orphans")
+	if err != nil {
+		return nil, err
 	}
-	hammer.Close()
 
-	for {
-		select {
-		case <-hammer.Done():
-			zlog.Info("hammer completion")
-			return
-		case trxInt, ok := <-hammer.Out:
-			if !ok {
-				return
-			}
-			trx := trxInt.(*Transaction)
-			maybeSendWebsocket(conn, WebsocketTypeTransaction, trx)
-		}
-	}
+	zlog.Info("diagnose - EOS  - KVDB Trx Validation", zap.Reflect("connection_info", kvdbInfo), zap.Bool("orphans", orphans))
+	return &checker.EOSKVDBTrxsValidation{DB: db, StartBlock: startBlock, StopBlock: stopBlock, Orphans: orphans}, nil
+}
 
+func (d *Diagnose) ETHKVDBTrxsValidation(w http.ResponseWriter, req *http.Request) {
+	d.serveCheck(w, req, d.newETHKVDBTrxsValidation)
 }
 
-func createTrxRowSets(concurrentReadCount int) []bt.RowRange {
-	letters := "123456789abcdef"
-	if concurrentReadCount > len(letters)+1 {
-		panic(fmt.Errorf("only accepting concurrent <= %d, got %d", len(letters), concurrentReadCount))
+func (d *Diagnose) newETHKVDBTrxsValidation(param paramFunc) (checker.Checker, error) {
+	kvdbInfo, db, err := d.getETHDatabase(param)
+	if err != nil {
+		return nil, err
 	}
 
-	step := int(math.Ceil(float64(len(letters)) / float64(concurrentReadCount)))
-	startPrefix := ""
-	var endPrefix string
-
-	var rowRanges []bt.RowRange
-
-	for i := 0; i < len(letters); i += step {
-		endPrefix = string(letters[i]) + strings.Repeat("0", 63) + ":"
-		rowRanges = append(rowRanges, bt.NewRange(startPrefix, endPrefix))
-
-		startPrefix = endPrefix
+	startBlock, stopBlock, err := blockBounds(param)
+	if err != nil {
+		return nil, err
 	}
 
-	// FIXME: Find a way to get up to last possible keys of `a:` set without copying the `prefixSuccessor` method from eosdb
-	//        Hard-coded for now.
-	rowRanges = append(rowRanges, bt.NewRange(startPrefix, strings.Repeat("f", 64)+";"))
+	concurrency, err := concurrencyParam(param)
+	if err != nil {
+		return nil, err
+	}
 
-	return rowRanges
+	zlog.Info("diagnose - ETH  - KVDB Trx Validation", zap.Reflect("connection_info", kvdbInfo))
+	return &checker.ETHKVDBTrxsValidation{
+		DB:          db,
+		StartBlock:  startBlock,
+		StopBlock:   stopBlock,
+		Concurrency: concurrency,
+	}, nil
 }
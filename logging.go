@@ -2,6 +2,7 @@ package main
 
 import (
 	"github.com/eoscanada/derr"
+	"github.com/eoscanada/diagnose/checker"
 	"github.com/eoscanada/logging"
 	"go.uber.org/zap"
 )
@@ -11,5 +12,6 @@ var zlog = zap.NewNop()
 func setupLogger() {
 	zlog = logging.MustCreateLoggerWithServiceName("diagnose")
 	derr.SetLogger(zlog)
+	checker.SetLogger(zlog)
 	//dmesh.SetLogger(zlog)
 }
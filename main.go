@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"os"
+	"time"
 
 	"github.com/eoscanada/derr"
 	"github.com/eoscanada/dmesh"
@@ -23,12 +26,23 @@ var flagSkipK8S = flag.Bool("skip-k8s", false, "Useful in development to avoid s
 var flagDev = flag.Bool("dev", false, "Useful in development to link to localhost:3000 instead of needing full react build")
 var flagMeshStoreAddr = flag.String("mesh-store-addr", ":2379", "address of the backing etcd cluster for mesh service discovery")
 var flagMeshServiceVersion = flag.String("mesh-service-version", "v1", "service version within dmesh")
+var flagJobsStorePath = flag.String("jobs-store-path", "./jobs", "Local directory where finished jobs and their results are kept")
+var flagScheduleConfig = flag.String("schedule-config", "", "JSON file listing the checks to run on a schedule and where to send alerts, no check is scheduled when empty")
+var flagPeerStuckAfter = flag.Duration("peer-stuck-after", 10*time.Minute, "Duration after which a search peer claiming a moving head, or tail, that did not move is flagged")
 var flagServeFilePath = flag.String("serve-file-path", "./frontend/public", "path to files to serve under `/`")
 
 func main() {
 	flag.Parse()
 	setupLogger()
 
+	if flag.Arg(0) == "check" {
+		os.Exit(runCheck(flag.Args()[1:]))
+	}
+
+	if flag.Arg(0) == "alert-receiver" {
+		os.Exit(runAlertReceiver(flag.Args()[1:]))
+	}
+
 	zlog.Info("checking up kvdb info")
 	_, err := kvdb.NewConnectionInfo(*flagBigTable)
 	derr.Check(fmt.Sprintf("unable to parse kvdb connection info %s", *flagBigTable), err)
@@ -49,7 +63,30 @@ func main() {
 		derr.Check("unable to create kubernetes client set", err)
 	}
 
-	diagnose := Diagnose{
+	diagnose := newDiagnoseFromFlags()
+	diagnose.cluster = cluster
+	diagnose.dmeshStore = dmeshStore
+
+	diagnose.SetupRoutes(*flagDev)
+	diagnose.jobs.resumeInterrupted(diagnose.checkFactories())
+	go diagnose.observeSearchPeers(context.Background())
+
+	if *flagScheduleConfig != "" {
+		config, err := loadScheduleConfig(*flagScheduleConfig)
+		derr.Check("unable to load schedule config", err)
+
+		scheduler, err := newScheduler(diagnose, config)
+		derr.Check("invalid schedule config", err)
+		scheduler.run(context.Background())
+	}
+
+	zlog.Info("serving http")
+	err = diagnose.Serve()
+	derr.Check("failed serving http", err)
+}
+
+func newDiagnoseFromFlags() *Diagnose {
+	return &Diagnose{
 		addr:                  *flagHTTPListenAddr,
 		Protocol:              *flagProtocol,
 		Namespace:             *flagNamespace,
@@ -59,14 +96,9 @@ func main() {
 		SearchShardSizes:      []uint32{50, 200, 500, 1000, 5000, 10000, 50000},
 		KvdbConnectionInfo:    *flagBigTable,
 		DmeshServiceVersion:   *flagMeshServiceVersion,
-		cluster:               cluster,
-		dmeshStore:            dmeshStore,
+		dmeshStoreAddr:        *flagMeshStoreAddr,
 		serveFilePath:         *flagServeFilePath,
+		jobsStorePath:         *flagJobsStorePath,
+		peerHistory:           newPeerHistory(*flagPeerStuckAfter),
 	}
-
-	diagnose.SetupRoutes(*flagDev)
-
-	zlog.Info("serving http")
-	err = diagnose.Serve()
-	derr.Check("failed serving http", err)
 }
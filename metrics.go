@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/eoscanada/diagnose/checker"
+	"github.com/eoscanada/dmesh"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Check metrics are labelled by check name, as used by `diagnose check`,
+// and by the store the check scanned. They are only updated when a check
+// completes.
+var (
+	checkHoleCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "diagnose_check_holes",
+		Help: "Number of holes, or other problems, reported by the last completed run of the check",
+	}, []string{"check", "store"})
+
+	checkHoleBlockCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "diagnose_check_hole_blocks",
+		Help: "Number of blocks in the holes reported by the last completed run of the check",
+	}, []string{"check", "store"})
+
+	checkLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "diagnose_check_last_success_timestamp_seconds",
+		Help: "Unix time at which the check last completed",
+	}, []string{"check", "store"})
+
+	checkDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "diagnose_check_duration_seconds",
+		Help: "Duration of the last completed run of the check",
+	}, []string{"check", "store"})
+)
+
+// Search peer metrics are labelled by peer host.
+var (
+	searchPeerHeadBlock = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "diagnose_search_peer_head_block",
+		Help: "Head block number of the dmesh search peer",
+	}, []string{"host"})
+
+	searchPeerIrreversibleBlock = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "diagnose_search_peer_irreversible_block",
+		Help: "Irreversible block number of the dmesh search peer",
+	}, []string{"host"})
+
+	searchPeerTailBlock = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "diagnose_search_peer_tail_block",
+		Help: "Tail block number of the dmesh search peer",
+	}, []string{"host"})
+
+	searchPeerReady = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "diagnose_search_peer_ready",
+		Help: "Whether the dmesh search peer is ready (1) or not (0)",
+	}, []string{"host"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		checkHoleCount,
+		checkHoleBlockCount,
+		checkLastSuccess,
+		checkDuration,
+		searchPeerHeadBlock,
+		searchPeerIrreversibleBlock,
+		searchPeerTailBlock,
+		searchPeerReady,
+	)
+}
+
+// recordCheckMetrics records the outcome of a completed check run.
+func recordCheckMetrics(name, store string, duration time.Duration, holeCount int, holeBlockCount uint64) {
+	checkHoleCount.WithLabelValues(name, store).Set(float64(holeCount))
+	checkHoleBlockCount.WithLabelValues(name, store).Set(float64(holeBlockCount))
+	checkLastSuccess.WithLabelValues(name, store).Set(float64(time.Now().Unix()))
+	checkDuration.WithLabelValues(name, store).Set(duration.Seconds())
+}
+
+// checkStore returns the store scanned by the named check out of its
+// parameters: the blocks or indexes store URL, or the KVDB connection
+// info.
+func (d *Diagnose) checkStore(name string, param paramFunc) string {
+	switch name {
+	case "block-holes":
+		return d.blocksURL(param)
+	case "search-holes":
+		return fmt.Sprintf("%s/shards-%d", strings.TrimSuffix(d.indexesURL(param), "/"), d.shardSize(param))
+	case "search-coverage":
+		return d.indexesURL(param)
+	case "search-tiers":
+		return fmt.Sprintf("%s%s/search", d.dmeshNamespaceKey(), d.searchPeersVersion(param))
+	case "search-peer-shards":
+		return d.indexesURL(param)
+	}
+
+	if connectionInfo := param("connection_info"); connectionInfo != "" {
+		return connectionInfo
+	}
+	return d.KvdbConnectionInfo
+}
+
+// holeBlockCount returns the number of blocks of an emitted hole range, 0
+// for any other object.
+func holeBlockCount(obj interface{}) uint64 {
+	if blockRange, ok := obj.(*checker.BlockRange); ok && blockRange.Status == checker.BlockRangeStatusHole {
+		return uint64(blockRange.EndBlock-blockRange.StarBlock) + 1
+	}
+	return 0
+}
+
+// holeCounter counts the holes emitted by a check on their way to the
+// wrapped emitter.
+type holeCounter struct {
+	emitter        checker.Emitter
+	holeCount      int
+	holeBlockCount uint64
+}
+
+func (c *holeCounter) Emit(objType string, obj interface{}) {
+	if isHole(obj) {
+		c.holeCount++
+		c.holeBlockCount += holeBlockCount(obj)
+	}
+	c.emitter.Emit(objType, obj)
+}
+
+// recordSearchPeerMetrics updates the metrics of a search peer out of its
+// dmesh event.
+func recordSearchPeerMetrics(event *dmesh.PeerEvent) {
+	peer, ok := event.Peer.(*dmesh.SearchPeer)
+	if !ok {
+		return
+	}
+
+	if peer.Deleted || event.EventName == PeerEventDelete {
+		deleteSearchPeerMetrics(peer.Host)
+		return
+	}
+
+	ready := 0.0
+	if peer.Ready {
+		ready = 1
+	}
+
+	searchPeerHeadBlock.WithLabelValues(peer.Host).Set(float64(peer.HeadBlock))
+	searchPeerIrreversibleBlock.WithLabelValues(peer.Host).Set(float64(peer.IrrBlock))
+	searchPeerTailBlock.WithLabelValues(peer.Host).Set(float64(peer.TailBlock))
+	searchPeerReady.WithLabelValues(peer.Host).Set(ready)
+}
+
+func deleteSearchPeerMetrics(host string) {
+	searchPeerHeadBlock.DeleteLabelValues(host)
+	searchPeerIrreversibleBlock.DeleteLabelValues(host)
+	searchPeerTailBlock.DeleteLabelValues(host)
+	searchPeerReady.DeleteLabelValues(host)
+}
@@ -4,7 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"net/http"
+	"path"
+	"strings"
+	"time"
 
+	"github.com/eoscanada/diagnose/checker"
 	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
 )
@@ -47,3 +51,67 @@ func maybeSendWebsocket(conn *websocket.Conn, objType string, obj interface{}) {
 		conn.Close()
 	}
 }
+
+func websocketEmitter(conn *websocket.Conn) checker.Emitter {
+	return checker.EmitterFunc(func(objType string, obj interface{}) {
+		maybeSendWebsocket(conn, objType, obj)
+	})
+}
+
+// serveCheck creates the check out of the request query parameters, then
+// upgrades the request to a websocket and streams every event emitted by
+// the check to it until the check completes or the websocket closes.
+// Requests that are not websocket upgrades are served as plain HTTP, see
+// `serveCheckHTTP`.
+func (d *Diagnose) serveCheck(w http.ResponseWriter, req *http.Request, factory checkFactory) {
+	c, err := factory(func(name string) string { return getQueryParam(req, name) })
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !websocket.IsWebSocketUpgrade(req) {
+		d.serveCheckHTTP(w, req, c)
+		return
+	}
+
+	conn, err := d.upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	go readWebsocket(conn, cancel)
+
+	if err := d.runServedCheck(ctx, req, c, websocketEmitter(conn)); err != nil {
+		zlog.Info("check failed", zap.Error(err))
+		maybeSendWebsocket(conn, WebsocketTypeMessage, checker.Message{Msg: err.Error()})
+	}
+	zlog.Info("diagnose - check completed", zap.String("path", req.URL.Path))
+}
+
+// runServedCheck runs a check served under `/api/*`, recording its metrics
+// when it completes.
+func (d *Diagnose) runServedCheck(ctx context.Context, req *http.Request, c checker.Checker, emitter checker.Emitter) error {
+	startTime := time.Now()
+	counter := &holeCounter{emitter: emitter}
+	err := c.Check(ctx, counter)
+
+	if err == nil && ctx.Err() == nil {
+		name := servedCheckName(req)
+		store := d.checkStore(name, func(name string) string { return getQueryParam(req, name) })
+		recordCheckMetrics(name, store, time.Since(startTime), counter.holeCount, counter.holeBlockCount)
+	}
+
+	return err
+}
+
+// servedCheckName returns the name of the check served by the request,
+// routes being named after their check: `/api/block_holes` serves
+// `block-holes`.
+func servedCheckName(req *http.Request) string {
+	return strings.Replace(path.Base(req.URL.Path), "_", "-", -1)
+}
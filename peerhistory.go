@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/eoscanada/dmesh"
+	"go.uber.org/zap"
+)
+
+const (
+	// peerHistoryRetention is how long the samples, and ready changes, of
+	// a peer are kept.
+	peerHistoryRetention = 24 * time.Hour
+
+	// peerSampleInterval spaces the samples of a peer whose head or
+	// irreversible block moved, so a day of half second blocks is kept
+	// in a few thousand samples.
+	peerSampleInterval = 30 * time.Second
+
+	// maxPeerSamples caps the samples, and ready changes, kept per peer
+	// within `peerHistoryRetention`, for peers flapping all day.
+	maxPeerSamples = 10000
+
+	// flapWindow and flapThreshold define a flapping peer: one that went
+	// from ready to not ready, or back, `flapThreshold` times within
+	// `flapWindow`.
+	flapWindow    = 10 * time.Minute
+	flapThreshold = 3
+
+	// deletedPeerRetention is how long a peer gone from dmesh stays in the
+	// history.
+	deletedPeerRetention = time.Hour
+)
+
+// Peer problems, as flagged in a `PeerHistory`.
+const (
+	PeerProblemStuck     = "stuck"
+	PeerProblemHeadMoves = "head_moves_contradicted"
+	PeerProblemTailMoves = "tail_moves_contradicted"
+	PeerProblemFlapping  = "flapping"
+	PeerProblemDeleted   = "deleted"
+)
+
+// PeerSample is the state of a search peer at the time its head,
+// irreversible or tail block, or its readiness, changed. Head and
+// irreversible block changes are sampled every `peerSampleInterval`.
+type PeerSample struct {
+	Time      time.Time `json:"time"`
+	TailBlock uint64    `json:"tailBlockNum"`
+	IrrBlock  uint64    `json:"irrBlockNum"`
+	HeadBlock uint64    `json:"headBlockNum"`
+	Ready     bool      `json:"ready"`
+}
+
+// PeerHistory is the recent history of a search peer, along with the
+// problems found in it.
+type PeerHistory struct {
+	PeerKey      string       `json:"peerKey"`
+	Host         string       `json:"host"`
+	Tier         uint32       `json:"tier"`
+	Ready        bool         `json:"ready"`
+	HeadMoves    bool         `json:"headMoves"`
+	TailMoves    bool         `json:"tailMoves"`
+	FirstSeen    time.Time    `json:"firstSeen"`
+	LastSeen     time.Time    `json:"lastSeen"`
+	DeletedAt    *time.Time   `json:"deletedAt,omitempty"`
+	HeadMovedAt  time.Time    `json:"headMovedAt"`
+	TailMovedAt  time.Time    `json:"tailMovedAt"`
+	ReadyChanges []time.Time  `json:"readyChanges"`
+	Samples      []PeerSample `json:"samples"`
+	Problems     []string     `json:"problems"`
+
+	// headMoved and tailMoved are set once a move is seen, `HeadMovedAt`
+	// and `TailMovedAt` being the first seen time until then.
+	headMoved bool
+	tailMoved bool
+}
+
+// peerHistory keeps a bounded history of every search peer observed on
+// dmesh. A peer claiming a moving head whose head did not change for
+// `stuckAfter` is stuck, a peer claiming a fixed head whose head changed
+// within `stuckAfter` contradicts its claim.
+type peerHistory struct {
+	lock       sync.Mutex
+	peers      map[string]*PeerHistory
+	stuckAfter time.Duration
+}
+
+func newPeerHistory(stuckAfter time.Duration) *peerHistory {
+	return &peerHistory{
+		peers:      map[string]*PeerHistory{},
+		stuckAfter: stuckAfter,
+	}
+}
+
+func (h *peerHistory) record(event *dmesh.PeerEvent, now time.Time) {
+	peer, ok := event.Peer.(*dmesh.SearchPeer)
+	if !ok {
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.prune(now)
+
+	history := h.peers[event.PeerKey]
+	if event.EventName == PeerEventDelete {
+		if history != nil && history.DeletedAt == nil {
+			history.DeletedAt = &now
+		}
+		return
+	}
+
+	sample := PeerSample{
+		Time:      now,
+		TailBlock: peer.TailBlock,
+		IrrBlock:  peer.IrrBlock,
+		HeadBlock: peer.HeadBlock,
+		Ready:     peer.Ready,
+	}
+
+	if history == nil || history.DeletedAt != nil {
+		history = &PeerHistory{
+			PeerKey:     event.PeerKey,
+			FirstSeen:   now,
+			HeadMovedAt: now,
+			TailMovedAt: now,
+			Samples:     []PeerSample{sample},
+		}
+		h.peers[event.PeerKey] = history
+	} else {
+		last := history.Samples[len(history.Samples)-1]
+		if last.HeadBlock != sample.HeadBlock {
+			history.HeadMovedAt = now
+			history.headMoved = true
+		}
+		if last.TailBlock != sample.TailBlock {
+			history.TailMovedAt = now
+			history.tailMoved = true
+		}
+		if last.Ready != sample.Ready {
+			history.ReadyChanges = appendBounded(history.ReadyChanges, now)
+		}
+		if last.HeadBlock != sample.HeadBlock || last.IrrBlock != sample.IrrBlock || last.TailBlock != sample.TailBlock || last.Ready != sample.Ready {
+			history.Samples = appendSample(history.Samples, sample)
+		}
+	}
+
+	history.Host = peer.Host
+	history.Tier = peer.TierLevel
+	history.Ready = peer.Ready
+	history.HeadMoves = peer.HasMovingHead
+	history.TailMoves = peer.HasMovingTail
+	history.LastSeen = now
+}
+
+// appendSample adds `sample` to the samples, dropping the ones older than
+// `peerHistoryRetention`. When only the head or irreversible block moved,
+// the samples are spaced by `peerSampleInterval`: the last sample stands
+// for the latest state and is replaced until the interval elapsed.
+func appendSample(samples []PeerSample, sample PeerSample) []PeerSample {
+	n := len(samples)
+	if n >= 2 && headOnlyChange(samples[n-2], samples[n-1]) && headOnlyChange(samples[n-1], sample) && samples[n-1].Time.Sub(samples[n-2].Time) < peerSampleInterval {
+		samples[n-1] = sample
+		return samples
+	}
+
+	samples = append(samples, sample)
+
+	first := 0
+	for first < len(samples)-1 && sample.Time.Sub(samples[first].Time) > peerHistoryRetention {
+		first++
+	}
+	if len(samples)-first > maxPeerSamples {
+		first = len(samples) - maxPeerSamples
+	}
+	return samples[first:]
+}
+
+// headOnlyChange returns whether only the head or irreversible block
+// changed from `previous` to `sample`.
+func headOnlyChange(previous, sample PeerSample) bool {
+	return previous.TailBlock == sample.TailBlock && previous.Ready == sample.Ready
+}
+
+func appendBounded(times []time.Time, t time.Time) []time.Time {
+	times = append(times, t)
+
+	first := 0
+	for first < len(times)-1 && t.Sub(times[first]) > peerHistoryRetention {
+		first++
+	}
+	if len(times)-first > maxPeerSamples {
+		first = len(times) - maxPeerSamples
+	}
+	return times[first:]
+}
+
+// reconcile drops the peers whose host is not in `hosts`, the hosts of the
+// peers found in dmesh, returning the dropped hosts. Peers deleted while
+// the observation was disconnected got no delete event.
+func (h *peerHistory) reconcile(hosts map[string]bool) (dropped []string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for key, history := range h.peers {
+		if history.DeletedAt == nil && !hosts[history.Host] {
+			delete(h.peers, key)
+			dropped = append(dropped, history.Host)
+		}
+	}
+	return dropped
+}
+
+// prune drops the peers deleted for longer than `deletedPeerRetention`.
+func (h *peerHistory) prune(now time.Time) {
+	for key, history := range h.peers {
+		if history.DeletedAt != nil && now.Sub(*history.DeletedAt) > deletedPeerRetention {
+			delete(h.peers, key)
+		}
+	}
+}
+
+// snapshot returns a copy of every peer history, sorted by tier and host,
+// with its problems as of `now`.
+func (h *peerHistory) snapshot(now time.Time) []*PeerHistory {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.prune(now)
+
+	out := []*PeerHistory{}
+	for _, history := range h.peers {
+		peer := *history
+		peer.Samples = append([]PeerSample{}, history.Samples...)
+		peer.ReadyChanges = append([]time.Time{}, history.ReadyChanges...)
+		peer.Problems = h.problems(history, now)
+		out = append(out, &peer)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Tier != out[j].Tier {
+			return out[i].Tier < out[j].Tier
+		}
+		return out[i].Host < out[j].Host
+	})
+	return out
+}
+
+// problems flags a deleted peer, a peer claiming a moving head whose head
+// did not move for `stuckAfter`, a peer whose `headMoves` or `tailMoves`
+// claim contradicts the movement seen within `stuckAfter`, and a peer
+// flapping between ready and not ready.
+func (h *peerHistory) problems(history *PeerHistory, now time.Time) []string {
+	problems := []string{}
+	if history.DeletedAt != nil {
+		problems = append(problems, PeerProblemDeleted)
+		return problems
+	}
+
+	if history.HeadMoves && now.Sub(history.HeadMovedAt) > h.stuckAfter {
+		problems = append(problems, PeerProblemStuck)
+	}
+	if !history.HeadMoves && history.headMoved && now.Sub(history.HeadMovedAt) <= h.stuckAfter {
+		problems = append(problems, PeerProblemHeadMoves)
+	}
+	if (history.TailMoves && now.Sub(history.TailMovedAt) > h.stuckAfter) || (!history.TailMoves && history.tailMoved && now.Sub(history.TailMovedAt) <= h.stuckAfter) {
+		problems = append(problems, PeerProblemTailMoves)
+	}
+
+	changes := 0
+	for _, changedAt := range history.ReadyChanges {
+		if now.Sub(changedAt) <= flapWindow {
+			changes++
+		}
+	}
+	if changes >= flapThreshold {
+		problems = append(problems, PeerProblemFlapping)
+	}
+
+	return problems
+}
+
+// observeSearchPeers keeps the search peer metrics and history up to date
+// with dmesh until `ctx` is done, observing the peers again after a
+// failure. Each observation starts by dropping the peers gone from dmesh.
+func (d *Diagnose) observeSearchPeers(ctx context.Context) {
+	zlog.Info("observing dmesh search peers", zap.String("namespace", d.Namespace), zap.String("version", d.DmeshServiceVersion))
+	for {
+		d.reconcileSearchPeers(ctx)
+		err := d.observePeers(ctx, d.DmeshServiceVersion, "search", func(event *dmesh.PeerEvent) {
+			recordSearchPeerMetrics(event)
+			d.peerHistory.record(event, time.Now())
+		})
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(10 * time.Second):
+		}
+		zlog.Info("observing dmesh search peers failed, retrying", zap.Error(err))
+	}
+}
+
+// reconcileSearchPeers drops the history and metrics of the search peers
+// absent from a snapshot of dmesh.
+func (d *Diagnose) reconcileSearchPeers(ctx context.Context) {
+	snapshot, err := d.peerSnapshot(ctx, d.DmeshServiceVersion, "search")
+	if err != nil {
+		zlog.Info("unable to reconcile dmesh search peers", zap.Error(err))
+		return
+	}
+
+	hosts := map[string]bool{}
+	for _, snapshotPeer := range snapshot.Peers {
+		if peer, ok := snapshotPeer.Peer.(*dmesh.SearchPeer); ok {
+			hosts[peer.Host] = true
+		}
+	}
+
+	for _, host := range d.peerHistory.reconcile(hosts) {
+		zlog.Info("dropping search peer gone from dmesh", zap.String("host", host))
+		deleteSearchPeerMetrics(host)
+	}
+}
+
+// searchPeerHistory implements `GET /api/search_peer_history`. The
+// optional `host` parameter selects a single peer, and `flagged=true`
+// only returns the peers with a problem.
+func (d *Diagnose) searchPeerHistory(w http.ResponseWriter, req *http.Request) {
+	flagged, err := boolParam(func(name string) string { return getQueryParam(req, name) }, "flagged")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	host := getQueryParam(req, "host")
+
+	peers := []*PeerHistory{}
+	for _, peer := range d.peerHistory.snapshot(time.Now()) {
+		if host != "" && peer.Host != host {
+			continue
+		}
+		if flagged && len(peer.Problems) == 0 {
+			continue
+		}
+		peers = append(peers, peer)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(peers)
+}
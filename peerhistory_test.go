@@ -0,0 +1,292 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/eoscanada/dmesh"
+)
+
+// peerStep is a dmesh event of the search peer under test, `at` after the
+// start of the test.
+type peerStep struct {
+	at        time.Duration
+	deleted   bool
+	head      uint64
+	tail      uint64
+	ready     bool
+	headMoves bool
+	tailMoves bool
+}
+
+func (s peerStep) event() *dmesh.PeerEvent {
+	peer := &dmesh.SearchPeer{}
+	peer.Host = "search-0"
+	peer.Ready = s.ready
+	peer.HeadBlock = s.head
+	peer.IrrBlock = s.head
+	peer.TailBlock = s.tail
+	peer.HasMovingHead = s.headMoves
+	peer.HasMovingTail = s.tailMoves
+
+	eventName := PeerEventUpdate
+	if s.deleted {
+		eventName = PeerEventDelete
+	}
+	return &dmesh.PeerEvent{EventName: eventName, PeerKey: "v1/search/search-0", Peer: peer}
+}
+
+func TestPeerHistoryProblems(t *testing.T) {
+	tests := []struct {
+		name             string
+		steps            []peerStep
+		checkAt          time.Duration
+		expectedGone     bool
+		expectedProblems []string
+		expectedSamples  int
+	}{
+		{
+			name: "moving head",
+			steps: []peerStep{
+				{at: 0, head: 10, ready: true, headMoves: true},
+				{at: time.Minute, head: 20, ready: true, headMoves: true},
+			},
+			checkAt:         5 * time.Minute,
+			expectedSamples: 2,
+		},
+		{
+			name: "stuck",
+			steps: []peerStep{
+				{at: 0, head: 10, ready: true, headMoves: true},
+				{at: time.Minute, head: 20, ready: true, headMoves: true},
+			},
+			checkAt:          12 * time.Minute,
+			expectedProblems: []string{PeerProblemStuck},
+			expectedSamples:  2,
+		},
+		{
+			name: "head moves contradicted",
+			steps: []peerStep{
+				{at: 0, head: 10, ready: true},
+				{at: time.Minute, head: 20, ready: true},
+			},
+			checkAt:          5 * time.Minute,
+			expectedProblems: []string{PeerProblemHeadMoves},
+			expectedSamples:  2,
+		},
+		{
+			name: "head moves contradiction out of window",
+			steps: []peerStep{
+				{at: 0, head: 10, ready: true},
+				{at: time.Minute, head: 20, ready: true},
+			},
+			checkAt:         12 * time.Minute,
+			expectedSamples: 2,
+		},
+		{
+			name: "fixed head",
+			steps: []peerStep{
+				{at: 0, head: 10, ready: true},
+				{at: 5 * time.Minute, head: 10, ready: true},
+			},
+			checkAt:         20 * time.Minute,
+			expectedSamples: 1,
+		},
+		{
+			name: "moving tail stuck",
+			steps: []peerStep{
+				{at: 0, head: 10, tail: 1, ready: true, tailMoves: true},
+			},
+			checkAt:          12 * time.Minute,
+			expectedProblems: []string{PeerProblemTailMoves},
+			expectedSamples:  1,
+		},
+		{
+			name: "fixed tail moved",
+			steps: []peerStep{
+				{at: 0, head: 10, tail: 1, ready: true},
+				{at: time.Minute, head: 10, tail: 2, ready: true},
+			},
+			checkAt:          5 * time.Minute,
+			expectedProblems: []string{PeerProblemTailMoves},
+			expectedSamples:  2,
+		},
+		{
+			name: "flapping",
+			steps: []peerStep{
+				{at: 0, head: 10, ready: true},
+				{at: time.Minute, head: 10, ready: false},
+				{at: 2 * time.Minute, head: 10, ready: true},
+				{at: 3 * time.Minute, head: 10, ready: false},
+			},
+			checkAt:          5 * time.Minute,
+			expectedProblems: []string{PeerProblemFlapping},
+			expectedSamples:  4,
+		},
+		{
+			name: "flapping out of window",
+			steps: []peerStep{
+				{at: 0, head: 10, ready: true},
+				{at: time.Minute, head: 10, ready: false},
+				{at: 2 * time.Minute, head: 10, ready: true},
+				{at: 3 * time.Minute, head: 10, ready: false},
+			},
+			checkAt:         14 * time.Minute,
+			expectedSamples: 4,
+		},
+		{
+			name: "deleted",
+			steps: []peerStep{
+				{at: 0, head: 10, ready: true, headMoves: true},
+				{at: time.Minute, deleted: true},
+			},
+			checkAt:          30 * time.Minute,
+			expectedProblems: []string{PeerProblemDeleted},
+			expectedSamples:  1,
+		},
+		{
+			name: "deleted then pruned",
+			steps: []peerStep{
+				{at: 0, head: 10, ready: true, headMoves: true},
+				{at: time.Minute, deleted: true},
+			},
+			checkAt:      62 * time.Minute,
+			expectedGone: true,
+		},
+		{
+			name: "reappeared after delete",
+			steps: []peerStep{
+				{at: 0, head: 10, ready: true, headMoves: true},
+				{at: time.Minute, deleted: true},
+				{at: 2 * time.Minute, head: 50, ready: true, headMoves: true},
+			},
+			checkAt:         3 * time.Minute,
+			expectedSamples: 1,
+		},
+		{
+			name: "reappeared after prune",
+			steps: []peerStep{
+				{at: 0, head: 10, ready: true, headMoves: true},
+				{at: time.Minute, deleted: true},
+				{at: 62 * time.Minute, head: 50, ready: true, headMoves: true},
+			},
+			checkAt:         63 * time.Minute,
+			expectedSamples: 1,
+		},
+	}
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			history := newPeerHistory(10 * time.Minute)
+			for _, step := range test.steps {
+				history.record(step.event(), start.Add(step.at))
+			}
+
+			peers := history.snapshot(start.Add(test.checkAt))
+			if test.expectedGone {
+				if len(peers) != 0 {
+					t.Fatalf("got %d peers, expected none", len(peers))
+				}
+				return
+			}
+
+			if len(peers) != 1 {
+				t.Fatalf("got %d peers, expected 1", len(peers))
+			}
+			peer := peers[0]
+
+			if len(peer.Problems) != 0 || len(test.expectedProblems) != 0 {
+				if !reflect.DeepEqual(peer.Problems, test.expectedProblems) {
+					t.Errorf("got problems %v, expected %v", peer.Problems, test.expectedProblems)
+				}
+			}
+			if len(peer.Samples) != test.expectedSamples {
+				t.Errorf("got %d samples, expected %d", len(peer.Samples), test.expectedSamples)
+			}
+		})
+	}
+}
+
+func TestAppendSample(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	sample := func(at time.Duration, head uint64, ready bool) PeerSample {
+		return PeerSample{Time: start.Add(at), HeadBlock: head, IrrBlock: head, Ready: ready}
+	}
+
+	tests := []struct {
+		name     string
+		samples  []PeerSample
+		expected []PeerSample
+	}{
+		{
+			name: "head moves within the interval",
+			samples: []PeerSample{
+				sample(0, 1, true),
+				sample(10*time.Second, 2, true),
+				sample(20*time.Second, 3, true),
+				sample(29*time.Second, 4, true),
+			},
+			expected: []PeerSample{
+				sample(0, 1, true),
+				sample(29*time.Second, 4, true),
+			},
+		},
+		{
+			name: "head moves across intervals",
+			samples: []PeerSample{
+				sample(0, 1, true),
+				sample(10*time.Second, 2, true),
+				sample(40*time.Second, 3, true),
+				sample(50*time.Second, 4, true),
+				sample(80*time.Second, 5, true),
+			},
+			expected: []PeerSample{
+				sample(0, 1, true),
+				sample(40*time.Second, 3, true),
+				sample(80*time.Second, 5, true),
+			},
+		},
+		{
+			name: "ready changes kept",
+			samples: []PeerSample{
+				sample(0, 1, true),
+				sample(10*time.Second, 2, true),
+				sample(15*time.Second, 2, false),
+				sample(20*time.Second, 2, true),
+			},
+			expected: []PeerSample{
+				sample(0, 1, true),
+				sample(10*time.Second, 2, true),
+				sample(15*time.Second, 2, false),
+				sample(20*time.Second, 2, true),
+			},
+		},
+		{
+			name: "samples past retention dropped",
+			samples: []PeerSample{
+				sample(0, 1, true),
+				sample(time.Hour, 2, true),
+				sample(25*time.Hour, 3, true),
+			},
+			expected: []PeerSample{
+				sample(time.Hour, 2, true),
+				sample(25*time.Hour, 3, true),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var actual []PeerSample
+			for _, sample := range test.samples {
+				actual = appendSample(actual, sample)
+			}
+
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("got %+v, expected %+v", actual, test.expected)
+			}
+		})
+	}
+}
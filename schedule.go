@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/eoscanada/diagnose/checker"
+	"go.uber.org/zap"
+)
+
+// scheduleConfig is the content of the `--schedule-config` JSON file.
+type scheduleConfig struct {
+	Schedules []*schedule `json:"schedules"`
+	Alerts    struct {
+		WebhookURL string `json:"webhookUrl"`
+	} `json:"alerts"`
+}
+
+// schedule runs a check every `Every`, a Go duration like `1h` or `6h`.
+// `Name` defaults to the check name, and must be unique.
+type schedule struct {
+	Name   string            `json:"name"`
+	Check  string            `json:"check"`
+	Every  string            `json:"every"`
+	Params map[string]string `json:"params"`
+
+	interval time.Duration
+}
+
+func loadScheduleConfig(path string) (*scheduleConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &scheduleConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("invalid schedule config %s: %s", path, err)
+	}
+
+	return config, nil
+}
+
+// scheduler runs the scheduled checks as jobs, compares every completed
+// run with the previous completed run of the same schedule and alerts
+// when holes appeared or were fixed in between.
+type scheduler struct {
+	diagnose  *Diagnose
+	schedules []*schedule
+	sinks     []alertSink
+}
+
+func newScheduler(d *Diagnose, config *scheduleConfig) (*scheduler, error) {
+	factories := d.checkFactories()
+	names := map[string]bool{}
+	for _, sched := range config.Schedules {
+		if _, found := factories[sched.Check]; !found {
+			return nil, fmt.Errorf("unknown check %q, available checks: %s", sched.Check, strings.Join(d.checkNames(), ", "))
+		}
+
+		if sched.Name == "" {
+			sched.Name = sched.Check
+		}
+		if names[sched.Name] {
+			return nil, fmt.Errorf("duplicate schedule name %q", sched.Name)
+		}
+		names[sched.Name] = true
+
+		interval, err := time.ParseDuration(sched.Every)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid interval %q for schedule %q", sched.Every, sched.Name)
+		}
+		sched.interval = interval
+	}
+
+	sinks := []alertSink{logAlertSink{}}
+	if config.Alerts.WebhookURL != "" {
+		sinks = append(sinks, newWebhookAlertSink(config.Alerts.WebhookURL))
+	}
+
+	return &scheduler{
+		diagnose:  d,
+		schedules: config.Schedules,
+		sinks:     sinks,
+	}, nil
+}
+
+func (s *scheduler) run(ctx context.Context) {
+	for _, sched := range s.schedules {
+		go s.runSchedule(ctx, sched)
+	}
+}
+
+// runSchedule runs the schedule's check forever. The first run happens one
+// interval after the schedule's last stored job, so restarting diagnose
+// does not run every check again.
+func (s *scheduler) runSchedule(ctx context.Context, sched *schedule) {
+	last, previous, err := s.lastRuns(sched)
+	if err != nil {
+		zlog.Error("unable to read previous runs of schedule, comparing with the next run", zap.String("schedule", sched.Name), zap.Error(err))
+	}
+
+	next := time.Now()
+	if last != nil {
+		next = last.CreatedAt.Add(sched.interval)
+	}
+
+	zlog.Info("check scheduled", zap.String("schedule", sched.Name), zap.String("check", sched.Check), zap.Duration("every", sched.interval), zap.Time("next_run", next))
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+
+		next = time.Now().Add(sched.interval)
+		job, events, err := s.runOnce(ctx, sched)
+		if err != nil {
+			zlog.Error("scheduled check failed", zap.String("schedule", sched.Name), zap.Error(err))
+			continue
+		}
+
+		if job.Status != JobStatusCompleted {
+			zlog.Warn("scheduled check did not complete, not comparing it", zap.String("schedule", sched.Name), zap.String("job_id", job.ID), zap.String("status", job.Status))
+			continue
+		}
+
+		current := &scheduledRun{job: job, holes: newJobHoles(job.Check, events)}
+		if previous == nil {
+			zlog.Info("first run of schedule, nothing to compare with", zap.String("schedule", sched.Name), zap.String("job_id", job.ID), zap.Int("hole_count", job.HoleCount))
+		} else if alert := current.compare(sched, previous); alert != nil {
+			s.alert(alert)
+		}
+		previous = current
+	}
+}
+
+func (s *scheduler) runOnce(ctx context.Context, sched *schedule) (*Job, []JobEvent, error) {
+	factory := s.diagnose.checkFactories()[sched.Check]
+	c, err := factory(func(name string) string { return sched.Params[name] })
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create check: %s", err)
+	}
+
+	job, err := s.diagnose.jobs.start(sched.Check, sched.Params, sched.Name, c)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return s.diagnose.jobs.wait(ctx, job.ID)
+}
+
+// lastRuns returns the schedule's most recent stored job, whatever its
+// status, and its most recent completed one.
+func (s *scheduler) lastRuns(sched *schedule) (last *Job, completed *scheduledRun, err error) {
+	jobs, err := s.diagnose.jobs.store.list()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, job := range jobs {
+		if job.Schedule != sched.Name {
+			continue
+		}
+		if last == nil {
+			last = job
+		}
+		if job.Status != JobStatusCompleted {
+			continue
+		}
+
+		_, events, found, err := s.diagnose.jobs.store.load(job.ID)
+		if err != nil || !found {
+			return last, nil, err
+		}
+		return last, &scheduledRun{job: job, holes: newJobHoles(job.Check, events)}, nil
+	}
+
+	return last, nil, nil
+}
+
+func (s *scheduler) alert(alert *Alert) {
+	for _, sink := range s.sinks {
+		if err := sink.send(alert); err != nil {
+			zlog.Error("unable to send alert", zap.String("schedule", alert.Schedule), zap.String("sink", sink.String()), zap.Error(err))
+		}
+	}
+}
+
+// scheduledRun is a completed run of a schedule.
+type scheduledRun struct {
+	job   *Job
+	holes *jobHoles
+}
+
+// compare returns the alert for the holes that appeared or were fixed
+// since the `previous` run, nil when there are none.
+func (r *scheduledRun) compare(sched *schedule, previous *scheduledRun) *Alert {
+	newHoles := r.holes.missingFrom(previous.holes)
+	fixedHoles := previous.holes.missingFrom(r.holes)
+	if len(newHoles) == 0 && len(fixedHoles) == 0 {
+		return nil
+	}
+
+	if newHoles == nil {
+		newHoles = []JobEvent{}
+	}
+	if fixedHoles == nil {
+		fixedHoles = []JobEvent{}
+	}
+
+	return &Alert{
+		Schedule:      sched.Name,
+		Check:         sched.Check,
+		JobID:         r.job.ID,
+		PreviousJobID: previous.job.ID,
+		HoleCount:     r.job.HoleCount,
+		NewHoles:      newHoles,
+		FixedHoles:    fixedHoles,
+	}
+}
+
+// jobHoles are the events of a job reporting a problem, identified by what
+// identifies the problem across runs.
+type jobHoles struct {
+	holes []jobHole
+	keys  map[string]bool
+}
+
+// jobHole is a problem reported by an event. Hole ranges are matched
+// across runs by overlap, as their bounds and message change when they
+// grow or shrink, other problems by their key.
+type jobHole struct {
+	key    string
+	ranged bool
+	start  uint32
+	end    uint32
+	event  JobEvent
+}
+
+func newJobHoles(check string, events []JobEvent) *jobHoles {
+	holes := &jobHoles{keys: map[string]bool{}}
+	for _, event := range events {
+		hole, isHole := newJobHole(check, event)
+		if !isHole {
+			continue
+		}
+
+		if !hole.ranged {
+			if holes.keys[hole.key] {
+				continue
+			}
+			holes.keys[hole.key] = true
+		}
+		holes.holes = append(holes.holes, hole)
+	}
+
+	return holes
+}
+
+// missingFrom returns the holes not found in `other`, in emission order.
+func (h *jobHoles) missingFrom(other *jobHoles) (out []JobEvent) {
+	for _, hole := range h.holes {
+		if !other.contains(hole) {
+			out = append(out, hole.event)
+		}
+	}
+	return
+}
+
+func (h *jobHoles) contains(hole jobHole) bool {
+	if !hole.ranged {
+		return h.keys[hole.key]
+	}
+
+	for _, other := range h.holes {
+		if other.ranged && other.key == hole.key && other.start <= hole.end && hole.start <= other.end {
+			return true
+		}
+	}
+	return false
+}
+
+// newJobHole returns the problem reported by an event, `isHole` being
+// false for events reporting no problem. Hole ranges are keyed by check,
+// type and store, other problems by check, type and block.
+func newJobHole(check string, event JobEvent) (hole jobHole, isHole bool) {
+	hole.event = event
+	switch event.Type {
+	case WebsocketTypeBlockRange:
+		var blockRange checker.BlockRange
+		if json.Unmarshal(event.Payload, &blockRange) != nil || blockRange.Status != checker.BlockRangeStatusHole {
+			return hole, false
+		}
+		hole.key = fmt.Sprintf("%s %s %s", check, event.Type, blockRange.Store)
+		hole.ranged = true
+		hole.start = blockRange.StarBlock
+		hole.end = blockRange.EndBlock
+		return hole, true
+
+	case WebsocketTypeFork:
+		var fork checker.Fork
+		if json.Unmarshal(event.Payload, &fork) != nil || fork.Problem == "" {
+			return hole, false
+		}
+		hole.key = fmt.Sprintf("%s %s %d", check, event.Type, fork.BlockNum)
+		return hole, true
+
+	case WebsocketTypeTransaction:
+		var trx checker.Transaction
+		if json.Unmarshal(event.Payload, &trx) != nil || trx.Problem == "" {
+			return hole, false
+		}
+		hole.key = fmt.Sprintf("%s %s %d %s", check, event.Type, trx.BlockNum, trx.Id)
+		return hole, true
+	}
+
+	return hole, false
+}
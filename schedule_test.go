@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/eoscanada/diagnose/checker"
+)
+
+func testJobEvent(t *testing.T, objType string, obj interface{}) JobEvent {
+	payload, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatalf("marshal %s: %s", objType, err)
+	}
+	return JobEvent{Type: objType, Payload: payload}
+}
+
+func TestNewJobHoles(t *testing.T) {
+	hole := testJobEvent(t, WebsocketTypeBlockRange, checker.NewMissingBlockRange(100, 199, "hole found (100 blocks)"))
+	otherHole := testJobEvent(t, WebsocketTypeBlockRange, checker.NewMissingBlockRange(100, 199, "hole found (100 blocks)"))
+	fork := testJobEvent(t, WebsocketTypeFork, &checker.Fork{BlockNum: 10, Problem: "2 irreversible blocks"})
+
+	tests := []struct {
+		name     string
+		events   []JobEvent
+		expected []JobEvent
+	}{
+		{
+			name: "problems only",
+			events: []JobEvent{
+				testJobEvent(t, WebsocketTypeBlockRange, checker.NewValidBlockRange(0, 99, "100 blocks")),
+				hole,
+				testJobEvent(t, WebsocketTypeMessage, &checker.Message{Msg: "done"}),
+				testJobEvent(t, WebsocketTypeFork, &checker.Fork{BlockNum: 9}),
+				fork,
+			},
+			expected: []JobEvent{hole, fork},
+		},
+		{
+			name:     "duplicate fork",
+			events:   []JobEvent{fork, fork},
+			expected: []JobEvent{fork},
+		},
+		{
+			name:     "hole ranges kept",
+			events:   []JobEvent{hole, otherHole},
+			expected: []JobEvent{hole, otherHole},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var actual []JobEvent
+			for _, hole := range newJobHoles("block-holes", test.events).holes {
+				actual = append(actual, hole.event)
+			}
+
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("got %s, expected %s", formatJobEvents(actual), formatJobEvents(test.expected))
+			}
+		})
+	}
+}
+
+func TestScheduledRunCompare(t *testing.T) {
+	holeRange := func(startBlock, endBlock uint32) JobEvent {
+		return testJobEvent(t, WebsocketTypeBlockRange, checker.NewMissingBlockRange(startBlock, endBlock, "hole found"))
+	}
+	kvdbHoleRange := func(startBlock, endBlock uint32) JobEvent {
+		blockRange := checker.NewMissingBlockRange(startBlock, endBlock, "missing in KVDB")
+		blockRange.Store = checker.StoreKVDB
+		return testJobEvent(t, WebsocketTypeBlockRange, blockRange)
+	}
+	fork := func(blockNum uint32, problem string) JobEvent {
+		return testJobEvent(t, WebsocketTypeFork, &checker.Fork{BlockNum: blockNum, Problem: problem})
+	}
+
+	tests := []struct {
+		name          string
+		previous      []JobEvent
+		current       []JobEvent
+		expectedNew   []JobEvent
+		expectedFixed []JobEvent
+		expectedAlert bool
+	}{
+		{
+			name:     "same holes",
+			previous: []JobEvent{holeRange(100, 199), fork(10, "2 irreversible blocks")},
+			current:  []JobEvent{holeRange(100, 199), fork(10, "2 irreversible blocks")},
+		},
+		{
+			name:     "hole grown at its high end",
+			previous: []JobEvent{holeRange(100, 199)},
+			current:  []JobEvent{holeRange(100, 299)},
+		},
+		{
+			name:     "hole grown at its low end",
+			previous: []JobEvent{holeRange(100, 199)},
+			current:  []JobEvent{holeRange(0, 199)},
+		},
+		{
+			name:     "holes merged",
+			previous: []JobEvent{holeRange(100, 199), holeRange(300, 399)},
+			current:  []JobEvent{holeRange(100, 399)},
+		},
+		{
+			name:     "fork problem changed",
+			previous: []JobEvent{fork(10, "2 irreversible blocks")},
+			current:  []JobEvent{fork(10, "3 irreversible blocks")},
+		},
+		{
+			name:          "new hole",
+			previous:      []JobEvent{holeRange(100, 199)},
+			current:       []JobEvent{holeRange(100, 199), holeRange(500, 599)},
+			expectedNew:   []JobEvent{holeRange(500, 599)},
+			expectedFixed: []JobEvent{},
+			expectedAlert: true,
+		},
+		{
+			name:          "fixed hole",
+			previous:      []JobEvent{holeRange(100, 199), fork(10, "2 irreversible blocks")},
+			current:       []JobEvent{holeRange(100, 199)},
+			expectedNew:   []JobEvent{},
+			expectedFixed: []JobEvent{fork(10, "2 irreversible blocks")},
+			expectedAlert: true,
+		},
+		{
+			name:          "hole moved to another store",
+			previous:      []JobEvent{holeRange(100, 199)},
+			current:       []JobEvent{kvdbHoleRange(100, 199)},
+			expectedNew:   []JobEvent{kvdbHoleRange(100, 199)},
+			expectedFixed: []JobEvent{holeRange(100, 199)},
+			expectedAlert: true,
+		},
+	}
+
+	sched := &schedule{Name: "holes", Check: "block-holes"}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			previous := &scheduledRun{job: &Job{ID: "previous"}, holes: newJobHoles(sched.Check, test.previous)}
+			current := &scheduledRun{job: &Job{ID: "current"}, holes: newJobHoles(sched.Check, test.current)}
+
+			alert := current.compare(sched, previous)
+			if !test.expectedAlert {
+				if alert != nil {
+					t.Fatalf("got alert with new %s, fixed %s, expected none", formatJobEvents(alert.NewHoles), formatJobEvents(alert.FixedHoles))
+				}
+				return
+			}
+
+			if alert == nil {
+				t.Fatalf("got no alert, expected one")
+			}
+			if alert.JobID != "current" || alert.PreviousJobID != "previous" {
+				t.Errorf("got jobs %q and %q, expected %q and %q", alert.JobID, alert.PreviousJobID, "current", "previous")
+			}
+			if !reflect.DeepEqual(alert.NewHoles, test.expectedNew) {
+				t.Errorf("got new %s, expected %s", formatJobEvents(alert.NewHoles), formatJobEvents(test.expectedNew))
+			}
+			if !reflect.DeepEqual(alert.FixedHoles, test.expectedFixed) {
+				t.Errorf("got fixed %s, expected %s", formatJobEvents(alert.FixedHoles), formatJobEvents(test.expectedFixed))
+			}
+		})
+	}
+}
+
+func formatJobEvents(events []JobEvent) (out []string) {
+	for _, event := range events {
+		out = append(out, event.Type+" "+string(event.Payload))
+	}
+	return
+}
@@ -4,102 +4,167 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"regexp"
 	"strconv"
-	"time"
+	"strings"
 
-	"github.com/eoscanada/dstore"
+	"github.com/eoscanada/diagnose/checker"
 	"go.uber.org/zap"
 )
 
 func (d *Diagnose) SearchHoles(w http.ResponseWriter, req *http.Request) {
-	shardSize, err := strconv.ParseUint(getQueryParam(req, "shard_size"), 10, 32)
+	d.serveCheck(w, req, d.newSearchHoles)
+}
+
+func (d *Diagnose) newSearchHoles(param paramFunc) (checker.Checker, error) {
+	shardSize := d.shardSize(param)
+	indexesURL := d.indexesURL(param)
+
+	startBlock, stopBlock, err := blockBounds(param)
 	if err != nil {
-		shardSize = uint64(d.SearchShardSize)
+		return nil, err
 	}
 
-	indexesURL := getQueryParam(req, "indexes_url")
-	if indexesURL == "" {
-		indexesURL = d.SearchIndexesStoreURL
+	deep, err := boolParam(param, "deep")
+	if err != nil {
+		return nil, err
 	}
 
 	zlog.Info("diagnose - search indexes",
 		zap.String("indexes_store_url", indexesURL),
-		zap.Uint32("default_shard_size", uint32(shardSize)),
+		zap.Uint32("shard_size", shardSize),
+		zap.Bool("deep", deep),
 	)
+	return &checker.SearchHoles{
+		IndexesStoreURL: indexesURL,
+		ShardSize:       shardSize,
+		StartBlock:      startBlock,
+		StopBlock:       stopBlock,
+		Deep:            deep,
+	}, nil
+}
 
-	conn, err := d.upgrader.Upgrade(w, req, nil)
+// shardSize reads the optional `shard_size` parameter, defaulting to the
+// configured shard size.
+func (d *Diagnose) shardSize(param paramFunc) uint32 {
+	shardSize, err := strconv.ParseUint(param("shard_size"), 10, 32)
 	if err != nil {
-		return
+		return d.SearchShardSize
 	}
-	defer conn.Close()
+	return uint32(shardSize)
+}
 
-	ctx, cancel := context.WithCancel(req.Context())
+// indexesURL reads the optional `indexes_url` parameter, defaulting to the
+// configured search indexes store.
+func (d *Diagnose) indexesURL(param paramFunc) string {
+	if indexesURL := param("indexes_url"); indexesURL != "" {
+		return indexesURL
+	}
+	return d.SearchIndexesStoreURL
+}
 
-	number := regexp.MustCompile(`.*/(\d+)\.bleve\.tar\.(zst|gz)$`)
+func (d *Diagnose) SearchCoverage(w http.ResponseWriter, req *http.Request) {
+	d.serveCheck(w, req, d.newSearchCoverage)
+}
 
-	var expected uint32
-	var count int
-	var baseNum32 uint32
-	seenFirstBlock := false
+// shardSizes reads the optional `shard_sizes` parameter, a comma
+// separated list, defaulting to the configured search shard sizes.
+func (d *Diagnose) shardSizes(param paramFunc) ([]uint32, error) {
+	value := param("shard_sizes")
+	if value == "" {
+		return d.SearchShardSizes, nil
+	}
 
-	shardPrefix := fmt.Sprintf("shards-%d/", shardSize)
-	startTime := time.Now()
+	var shardSizes []uint32
+	for _, part := range strings.Split(value, ",") {
+		shardSize, err := strconv.ParseUint(strings.TrimSpace(part), 10, 32)
+		if err != nil || shardSize == 0 {
+			return nil, fmt.Errorf("invalid shard size %q in shard_sizes", part)
+		}
+		shardSizes = append(shardSizes, uint32(shardSize))
+	}
+	return shardSizes, nil
+}
 
-	currentStartBlk := uint32(0)
+func (d *Diagnose) newSearchCoverage(param paramFunc) (checker.Checker, error) {
+	shardSizes, err := d.shardSizes(param)
+	if err != nil {
+		return nil, err
+	}
 
-	go readWebsocket(conn, cancel)
+	indexesURL := d.indexesURL(param)
 
-	zlog.Info("creating indexes store")
-	searchStore, err := dstore.NewSimpleStore(indexesURL)
+	startBlock, stopBlock, err := blockBounds(param)
 	if err != nil {
-		maybeSendWebsocket(conn, WebsocketTypeMessage, Message{Msg: err.Error()})
-		return
+		return nil, err
 	}
 
-	maybeSendWebsocket(conn, WebsocketTypeProgress, Progress{Elapsed: time.Now().Sub(startTime)})
-	_ = searchStore.Walk(shardPrefix, "", func(filename string) error {
+	zlog.Info("diagnose - search coverage",
+		zap.String("indexes_store_url", indexesURL),
+		zap.Reflect("shard_sizes", shardSizes),
+	)
+	return &checker.SearchCoverage{
+		IndexesStoreURL: indexesURL,
+		ShardSizes:      shardSizes,
+		StartBlock:      startBlock,
+		StopBlock:       stopBlock,
+	}, nil
+}
 
-		if count%5000 == 0 {
-			maybeSendWebsocket(conn, WebsocketTypeProgress, Progress{Elapsed: time.Now().Sub(startTime)})
-		}
+func (d *Diagnose) SearchTiers(w http.ResponseWriter, req *http.Request) {
+	d.serveCheck(w, req, d.newSearchTiers)
+}
 
-		select {
-		case <-ctx.Done():
-			zlog.Debug("context canceled")
-			return dstore.StopIteration
-		default:
+func (d *Diagnose) newSearchTiers(param paramFunc) (checker.Checker, error) {
+	var headBlock uint32
+	if value := param("head_block"); value != "" {
+		num, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid head_block %q: %s", value, err)
 		}
+		headBlock = uint32(num)
+	}
 
-		match := number.FindStringSubmatch(filename)
-		if match == nil {
-			return nil
-		}
+	version := d.searchPeersVersion(param)
 
-		count++
-		baseNum, _ := strconv.ParseUint(match[1], 10, 32)
-		baseNum32 = uint32(baseNum)
+	zlog.Info("diagnose - search tiers",
+		zap.String("namespace", d.Namespace),
+		zap.String("version", version),
+		zap.Uint32("head_block", headBlock),
+	)
+	return &checker.SearchTiers{
+		Peers: func(ctx context.Context) ([]*checker.SearchTierPeer, error) {
+			return d.searchTierPeers(ctx, version)
+		},
+		HeadBlock: headBlock,
+	}, nil
+}
 
-		if !seenFirstBlock {
-			currentStartBlk = baseNum32
-			expected = baseNum32
-			seenFirstBlock = true
-		}
+func (d *Diagnose) SearchPeerShards(w http.ResponseWriter, req *http.Request) {
+	d.serveCheck(w, req, d.newSearchPeerShards)
+}
 
-		if baseNum32 != expected {
-			maybeSendWebsocket(conn, WebsocketTypeBlockRange, NewValidBlockRange(currentStartBlk, (expected-uint32(shardSize)), "valid range"))
-			maybeSendWebsocket(conn, WebsocketTypeBlockRange, NewMissingBlockRange(expected, (baseNum32-uint32(shardSize)), "hole found"))
-			currentStartBlk = baseNum32
-		}
-		expected = baseNum32 + uint32(shardSize)
+func (d *Diagnose) newSearchPeerShards(param paramFunc) (checker.Checker, error) {
+	indexesURL := d.indexesURL(param)
+	version := d.searchPeersVersion(param)
 
-		if count%1000 == 0 {
-			maybeSendWebsocket(conn, WebsocketTypeBlockRange, NewValidBlockRange(currentStartBlk, baseNum32, "valid range"))
-			currentStartBlk = baseNum32 + uint32(shardSize)
-		}
+	zlog.Info("diagnose - search peer shards",
+		zap.String("indexes_store_url", indexesURL),
+		zap.String("namespace", d.Namespace),
+		zap.String("version", version),
+	)
+	return &checker.SearchPeerShards{
+		IndexesStoreURL: indexesURL,
+		Peers: func(ctx context.Context) ([]*checker.SearchTierPeer, error) {
+			return d.searchTierPeers(ctx, version)
+		},
+	}, nil
+}
 
-		return nil
-	})
-	maybeSendWebsocket(conn, WebsocketTypeBlockRange, NewValidBlockRange(currentStartBlk, baseNum32, "valid range"))
-	zlog.Info("diagnose - search indexes - completed")
+// searchPeersVersion reads the optional `version` parameter, defaulting to
+// the configured dmesh service version.
+func (d *Diagnose) searchPeersVersion(param paramFunc) string {
+	if version := param("version"); version != "" {
+		return version
+	}
+	return d.DmeshServiceVersion
 }
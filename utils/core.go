@@ -3,13 +3,19 @@ package utils
 import bt "cloud.google.com/go/bigtable"
 
 func HasAllColumns(row bt.Row, columns ...string) bool {
+	return len(MissingColumns(row, columns...)) == 0
+}
+
+// MissingColumns returns the columns absent from the row, in the order
+// they were given, or nil when the row has all of them.
+func MissingColumns(row bt.Row, columns ...string) (missing []string) {
 	for _, column := range columns {
 		if !HasBtColumn(row, column) {
-			return false
+			missing = append(missing, column)
 		}
 	}
 
-	return true
+	return
 }
 
 func HasBtColumn(row bt.Row, familyColumn string) bool {